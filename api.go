@@ -36,6 +36,10 @@ type Partition struct {
 	// of node names.  For example, {"primary": ["a"], "replica": ["b",
 	// "c"]}.
 	NodesByState map[string][]string `json:"nodesByState"`
+
+	// KeyRange is optional, for applications that shard a key space
+	// by ranges of keys.  See ValidateKeyRanges().
+	KeyRange *KeyRange `json:"keyRange,omitempty"`
 }
 
 // A PartitionModel lets applications define different states for each
@@ -105,6 +109,56 @@ type HierarchyRule struct {
 	// upwards in a containment hierarchy to find an exclusion set of
 	// nodes.
 	ExcludeLevel int `json:"excludeLevel"`
+
+	// Required, when true, means that when the rule has no candidate
+	// nodes, the rule's node slot is left unfilled and a Warning of
+	// WarningHierarchyRequired is reported.  Otherwise, the rule is
+	// only preferred, so the best other node is used instead and a
+	// Warning of WarningHierarchyPreferred is reported.
+	Required bool `json:"required,omitempty"`
+
+	// AnchorState is optional; by default, a rule is relative to the
+	// first node of the top priority state (e.g., the first primary).
+	// When AnchorState is a stateName, the rule is instead relative to
+	// every node holding the partition in that state, where the
+	// candidate nodes are those included for any anchor node, but not
+	// excluded by any anchor node.  For example, an AnchorState of
+	// "primary" with IncludeLevel of 2 and ExcludeLevel of 1 means a
+	// rack different from every primary.  When AnchorState is the
+	// state that is being assigned, the anchors are the nodes chosen
+	// by the earlier rules for that state, allowing for chains of
+	// replicas that are each on a different rack.
+	AnchorState string `json:"anchorState,omitempty"`
+}
+
+// A SpreadRule is metadata for spreading all the copies of a
+// partition, counted across every partition state, amongst the failure
+// domains at a level of the containment hierarchy.  For example, for
+// this containment tree, (zone0 (rack0 (nodeA nodeB)) (rack1 (nodeC
+// nodeD))), a Level of 1 means the failure domains are the racks,
+// rack0 and rack1, and a MaxPerDomain of 1 means a partition with a
+// primary on nodeA must have its replica on nodeC or nodeD.
+type SpreadRule struct {
+	// Level defines how many parents or ancestors to traverse
+	// upwards in a containment hierarchy from a node to find the
+	// node's failure domain.
+	Level int `json:"level"`
+
+	// MaxPerDomain, when > 0, is the most copies of a partition that
+	// may be assigned to nodes of the same failure domain.
+	MaxPerDomain int `json:"maxPerDomain"`
+
+	// MinDomains, when > 0, is the least number of distinct failure
+	// domains that the copies of a partition should be assigned to.
+	MinDomains int `json:"minDomains"`
+
+	// QuorumSafe, when true, means that no failure domain may hold a
+	// majority (n/2 + 1) of the n copies of a partition, counted
+	// across every state, as needed by consensus-replicated (e.g.,
+	// raft) partitions to survive the loss of any single domain.  A
+	// partition with a single copy can't be quorum safe, so it's
+	// reported as a WarningSpreadRules.  See also CheckQuorumSafe().
+	QuorumSafe bool `json:"quorumSafe,omitempty"`
 }
 
 // PlanNextMap is deprecated.  Applications should instead use the
@@ -137,7 +191,8 @@ func PlanNextMap(
 // partitions to nodes.  The prevMap must define the partitions.
 // Partitions must be stable between PlanNextMapEx() runs.  That is,
 // splitting and merging or partitions are an orthogonal concern and
-// must be done separately than PlanNextMapEx() invocations.  The
+// must be done separately than PlanNextMapEx() invocations, such as
+// with SplitPartition() and MergePartitions().  The
 // nodeAll parameters is all nodes (union of existing nodes, nodes to
 // be added, nodes to be removed, nodes that aren't changing).  The
 // nodesToRemove may be empty.  The nodesToAdd may be empty.  When
@@ -151,10 +206,117 @@ func PlanNextMapEx(
 	nodesToAdd []string,
 	model PartitionModel,
 	options PlanNextMapOptions) (nextMap PartitionMap, warnings []string) {
+	nextMap, ws := planNextMapEx(prevMap, nodesAll, nodesToRemove,
+		nodesToAdd, model, options)
+	return nextMap, warningsToStrings(ws)
+}
+
+// PlanNextMapDetailed is the same as PlanNextMapEx(), but returns
+// the warnings as structured Warning's, so that applications can
+// react to specific kinds of warnings.
+func PlanNextMapDetailed(
+	prevMap PartitionMap,
+	nodesAll, // Union of nodesBefore, nodesToAdd, nodesToRemove.
+	nodesToRemove,
+	nodesToAdd []string,
+	model PartitionModel,
+	options PlanNextMapOptions) (nextMap PartitionMap, warnings []*Warning) {
 	return planNextMapEx(prevMap, nodesAll, nodesToRemove, nodesToAdd,
 		model, options)
 }
 
+// A Warning represents an issue found by the planner, such as
+// constraints that could not be met for a partition.  The Kind allows
+// applications to programmatically distinguish different warnings,
+// while the Message is meant for humans.
+type Warning struct {
+	Kind          string `json:"kind"` // Ex: WarningConstraints.
+	PartitionName string `json:"partitionName,omitempty"`
+	StateName     string `json:"stateName,omitempty"`
+	Message       string `json:"message"`
+}
+
+// String returns the human readable Message of the Warning.
+func (w *Warning) String() string {
+	return w.Message
+}
+
+// The kinds of Warning's that the planner may report.
+const (
+	// WarningConstraints means the constraints for a partition state
+	// could not be met, such as when there are not enough nodes.
+	WarningConstraints = "constraints"
+
+	// WarningZeroNodeWeights means the constraints for a partition
+	// state could not be met because of nodes having weight of 0.
+	WarningZeroNodeWeights = "zeroNodeWeights"
+
+	// WarningNodeSelectors means the constraints for a partition
+	// state could not be met because not enough nodes have labels
+	// that match the node selectors.
+	WarningNodeSelectors = "nodeSelectors"
+
+	// WarningNodeTaints means the constraints for a partition state
+	// could not be met because not enough nodes are free of
+	// NoSchedule taints that the partition doesn't tolerate.
+	WarningNodeTaints = "nodeTaints"
+
+	// WarningSpreadRules means the copies of a partition could not be
+	// spread across failure domains as required by the SpreadRules.
+	WarningSpreadRules = "spreadRules"
+
+	// WarningHierarchyRequired means a required HierarchyRule had no
+	// candidate nodes, so a node slot for a partition state was left
+	// unfilled.
+	WarningHierarchyRequired = "hierarchyRequired"
+
+	// WarningHierarchyPreferred means a preferred HierarchyRule had
+	// no candidate nodes, so a node that violates the rule was used.
+	WarningHierarchyPreferred = "hierarchyPreferred"
+
+	// WarningDomainQuotas means a domain lacked enough nodes to meet
+	// its DomainStateQuotas for a partition state.
+	WarningDomainQuotas = "domainQuotas"
+
+	// WarningPreferredPlacement reports how many partitions could not
+	// be placed on the preferred nodes of a state.
+	WarningPreferredPlacement = "preferredPlacement"
+
+	// WarningCopysets means the copies of a partition could not all
+	// be placed within a single one of the Copysets.
+	WarningCopysets = "copysets"
+
+	// WarningFailover means a partition was left with no nodes in the
+	// top priority state by PlanFailover(), as there was no surviving
+	// copy to promote.
+	WarningFailover = "failover"
+
+	// WarningHealing means PlanHealing() could not restore all the
+	// missing copies of a partition state, such as when there are not
+	// enough nodes.
+	WarningHealing = "healing"
+
+	// WarningNodeReplacements means a NodeReplacements entry was
+	// ignored, as its old node was not being removed, or its new node
+	// was not being added or was already replacing another node.
+	WarningNodeReplacements = "nodeReplacements"
+
+	// WarningScope means a partition had too few ScopeNodes to meet
+	// the constraints of a state.
+	WarningScope = "scope"
+)
+
+func warningsToStrings(warnings []*Warning) []string {
+	if warnings == nil {
+		return nil
+	}
+	rv := make([]string, 0, len(warnings))
+	for _, w := range warnings {
+		rv = append(rv, w.String())
+	}
+	return rv
+}
+
 // PlanNextMapOptions represents optional parameters to the
 // PlanNextMapEx() API.  The ModelStateConstraints allows the caller
 // to override the constraints defined in the model.  The
@@ -168,7 +330,8 @@ func PlanNextMapEx(
 // default state stickiness is 1.5.  The NodeWeights is optional and
 // is keyed by node name; it allows the caller to specify that some
 // nodes can hold more partitions than other nodes; default node
-// weight is 1.  The NodeHierarchy defines optional parent
+// weight is 1; a node weight of 0 means the node receives no new
+// partition assignments.  The NodeHierarchy defines optional parent
 // relationships per node; it is keyed by node and a value is the
 // node's parent.  The HierarchyRules allows the caller to optionally
 // define replica placement policy (e.g., same/different rack;
@@ -180,4 +343,179 @@ type PlanNextMapOptions struct {
 	NodeWeights           map[string]int    // Keyed by node.
 	NodeHierarchy         map[string]string // Keyed by node; value is node's parent.
 	HierarchyRules        HierarchyRules
+
+	// StateLoadFactor is optional and is keyed by stateName; it
+	// allows the caller to specify that a partition in some state
+	// costs a node more than in another state (e.g., a "primary" of
+	// 1.0 and a "replica" of 0.3) when the overall load of a node is
+	// computed; default state load factor is 1.0.
+	StateLoadFactor map[string]float64
+
+	// StateNodeWeights is optional and is keyed by stateName, then by
+	// node name; it allows the caller to specify that some nodes can
+	// hold more partitions of a given state than other nodes (e.g.,
+	// nodes with fast CPU's might take more "primary" partitions
+	// while nodes with big disks might take more "replica"
+	// partitions).  When a node has no entry for a state, the node's
+	// NodeWeights entry is used instead.  A node with an explicit
+	// weight of 0 for a state receives no new assignments of that
+	// state.
+	StateNodeWeights map[string]map[string]int
+
+	// DrainZeroWeightNodes, when true, means that a node with an
+	// explicit weight of 0 for a state also gives up the partitions
+	// it already holds in that state.  When false, a zero weight
+	// node keeps its existing assignments but receives no new ones.
+	DrainZeroWeightNodes bool
+
+	// NodeLabels is optional and is keyed by node name; the value is
+	// the node's labels, such as {"ssd": "true", "tier": "gold"}.
+	NodeLabels map[string]map[string]string
+
+	// StateNodeSelectors is optional and is keyed by stateName; a
+	// partition is assigned in that state only to nodes whose
+	// NodeLabels have every key/value pair of the selector.  For
+	// example, {"primary": {"ssd": "true"}} places primaries only on
+	// nodes labeled with ssd=true.
+	StateNodeSelectors map[string]map[string]string
+
+	// PartitionNodeSelectors is optional and is keyed by
+	// partitionName; a partition is assigned in any state only to
+	// nodes whose NodeLabels have every key/value pair of the
+	// selector.
+	PartitionNodeSelectors map[string]map[string]string
+
+	// NodeTaints is optional and is keyed by node name; a tainted
+	// node repels partitions that don't have a matching toleration in
+	// PartitionTolerations.  For example, nodes reserved for a
+	// premium tenant, or nodes under hardware suspicion.
+	NodeTaints map[string][]Taint
+
+	// PartitionTolerations is optional and is keyed by
+	// partitionName; it allows a partition to be assigned to nodes
+	// with matching NodeTaints.
+	PartitionTolerations map[string][]Toleration
+
+	// SpreadRules is optional and allows the caller to spread all the
+	// copies of a partition, across every state, amongst the failure
+	// domains of the NodeHierarchy (e.g., 3 copies across 3 distinct
+	// zones, or at most 2 copies per rack).
+	SpreadRules []*SpreadRule
+
+	// BalanceLevels is optional and lists the levels of the
+	// NodeHierarchy (e.g., 1 for racks, 2 for zones) where the
+	// aggregate load of each failure domain should also be balanced,
+	// in proportion to the domain's capacity, which is the sum of the
+	// weights of the domain's nodes.  Without BalanceLevels, only the
+	// load of each node is balanced.
+	BalanceLevels []int
+
+	// DomainStateQuotas is optional and is keyed by a domain, which
+	// is an interior node of the NodeHierarchy (e.g., "dc1"), and
+	// then by stateName; the value is how many nodes under that
+	// domain should be assigned a partition in that state.  For
+	// example, {"dc1": {"replica": 2}, "dc2": {"replica": 1}} means
+	// 2 replicas in dc1 and 1 replica in dc2.  When the quotas of a
+	// state add up to less than its constraints, the remaining nodes
+	// are chosen from outside of the domains whose quotas are met.
+	DomainStateQuotas map[string]map[string]int
+
+	// PreferredNodes is optional and is keyed by stateName; it lists
+	// the nodes that should preferably be assigned partitions in that
+	// state, when balance allows (e.g., primaries near clients).
+	PreferredNodes map[string][]string
+
+	// PreferredDomains is optional and is keyed by stateName; it
+	// lists the domains, which are interior nodes of the
+	// NodeHierarchy (e.g., "zone1"), whose nodes should preferably be
+	// assigned partitions in that state, when balance allows.
+	PreferredDomains map[string][]string
+
+	// PreferredBonus is the score bonus, roughly in units of
+	// partitions, of the PreferredNodes and PreferredDomains, so a
+	// larger bonus trades off more imbalance for more preferred
+	// placements.  When <= 0, the DefaultPreferredBonus is used.
+	PreferredBonus float64
+
+	// Copysets is optional and lists groups of nodes, such as from
+	// GenerateCopysets(); when provided, all the copies of a
+	// partition, across every state, are assigned to nodes within a
+	// single copyset.  Bounding the number of distinct replica sets
+	// reduces the chance that a few concurrent node failures lose
+	// every copy of some partition.
+	Copysets [][]string
+
+	// NodeReplacements is optional and is keyed by a node in the
+	// nodesToRemove, where the value is a node in the nodesToAdd that
+	// replaces it (e.g., when replacing hardware).  Each replaced
+	// node's partitions are assigned to its replacement in the same
+	// states, so that when every removed and added node is paired,
+	// nothing else is moved.  Nodes without a replacement are planned
+	// as usual.
+	NodeReplacements map[string]string
+
+	// AutoNodeReplacements, when true and NodeReplacements is nil,
+	// pairs the nodesToRemove and nodesToAdd by their position in the
+	// NodeHierarchy, as in PairNodeReplacements().
+	AutoNodeReplacements bool
+
+	// ScopePartitions is optional and limits the rebalance to the
+	// listed partitions (e.g., the partitions of a single tenant).
+	// The assignments of the other partitions are left as is, but
+	// still count towards the load of their nodes.
+	ScopePartitions []string
+
+	// ScopeNodes is optional and limits the rebalance to the listed
+	// nodes (e.g., the nodes of a single rack), so that partitions are
+	// only assigned to or unassigned from those nodes.  The
+	// assignments on the other nodes, including nodes being removed,
+	// are left as is, but still count towards the load of their nodes
+	// and the constraints of their partitions.
+	ScopeNodes []string
+
+	// BalanceTolerance is optional and is a fraction, such as 0.1 for
+	// 10%, that avoids churn for marginal gains in balance.  When the
+	// weighted load of every node in every state is within the
+	// BalanceTolerance of its fair share for the state, the prevMap is
+	// returned as is; otherwise, only enough partitions are moved to
+	// bring every node within the BalanceTolerance, along with the
+	// moves needed for the nodesToRemove, the constraints and the
+	// placement rules, such as the selectors, taints, spread rules,
+	// quotas, copysets and required hierarchy rules.  The warnings
+	// are for the returned map.
+	BalanceTolerance float64
+}
+
+// A Taint marks a node so that it repels partitions that don't
+// tolerate the taint.  A taint with an Effect of TaintNoSchedule
+// means the node is not assigned any untolerating partitions, and
+// any it holds are moved elsewhere.  A taint with an Effect of
+// TaintPreferNoSchedule means the node is only penalized by the
+// SoftTaintPenalty when scoring nodes for untolerating partitions.
+type Taint struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Effect string `json:"effect"` // Ex: TaintNoSchedule.
+}
+
+// The effects of a Taint.
+const (
+	TaintNoSchedule       = "NoSchedule"
+	TaintPreferNoSchedule = "PreferNoSchedule"
+)
+
+// A Toleration allows a partition to be assigned to nodes that have a
+// matching Taint.  The Key must equal the taint's Key, while an empty
+// Value or an empty Effect matches any taint Value or Effect.
+type Toleration struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Effect string `json:"effect,omitempty"`
+}
+
+// Tolerates returns true if the toleration matches the taint.
+func (t Toleration) Tolerates(taint Taint) bool {
+	return t.Key == taint.Key &&
+		(t.Value == "" || t.Value == taint.Value) &&
+		(t.Effect == "" || t.Effect == taint.Effect)
 }
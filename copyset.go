@@ -0,0 +1,178 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// GenerateCopysets returns groups of copysetSize nodes, where each
+// node shares a copyset with roughly scatterWidth other nodes, for
+// use as the Copysets of the PlanNextMapOptions.  The copysets are
+// built by chunking ceil(scatterWidth / (copysetSize - 1)) random
+// permutations of the nodes, where the nodes of a chunk are chosen,
+// when possible, from distinct domains at the given level of the
+// nodeHierarchy.  The nodeHierarchy is optional and is keyed by node,
+// where a value is the node's parent.  The seed allows for repeatable
+// results.
+func GenerateCopysets(nodes []string, copysetSize, scatterWidth int,
+	nodeHierarchy map[string]string, level int, seed int64) [][]string {
+	if copysetSize <= 0 || len(nodes) <= 0 {
+		return nil
+	}
+	if copysetSize > len(nodes) {
+		copysetSize = len(nodes)
+	}
+
+	numPermutations := 1
+	if copysetSize > 1 && scatterWidth > copysetSize-1 {
+		numPermutations = (scatterWidth + copysetSize - 2) / (copysetSize - 1)
+	}
+
+	r := rand.New(rand.NewSource(seed))
+
+	var rv [][]string
+
+	seen := map[string]bool{} // Keyed by joined copyset.
+
+	for p := 0; p < numPermutations; p++ {
+		perm := append([]string(nil), nodes...)
+		r.Shuffle(len(perm), func(i, j int) { perm[i], perm[j] = perm[j], perm[i] })
+
+		used := map[string]bool{}
+		for len(used) < len(perm) {
+			var copyset []string
+			members := map[string]bool{}
+			domains := map[string]bool{}
+
+			// First favor unused nodes from new domains, then any
+			// unused nodes, then wrap around to the used nodes.
+			for pass := 0; pass < 4 && len(copyset) < copysetSize; pass++ {
+				for _, node := range perm {
+					if len(copyset) >= copysetSize {
+						break
+					}
+					domain := spreadDomain(node, level, nodeHierarchy)
+					if members[node] || (pass < 2 && used[node]) ||
+						(pass%2 == 0 && domains[domain]) {
+						continue
+					}
+					copyset = append(copyset, node)
+					members[node] = true
+					domains[domain] = true
+				}
+			}
+
+			for _, node := range copyset {
+				used[node] = true
+			}
+
+			sort.Strings(copyset)
+
+			k := strings.Join(copyset, "\x00")
+			if !seen[k] {
+				seen[k] = true
+				rv = append(rv, copyset)
+			}
+		}
+	}
+
+	return rv
+}
+
+// CountCopysets returns the number of distinct sets of nodes, across
+// every state, that the partitions of the partitionMap are assigned
+// to.  A lower count means fewer combinations of concurrent node
+// failures can lose every copy of some partition.
+func CountCopysets(partitionMap PartitionMap) int {
+	seen := map[string]bool{}
+	for _, partition := range partitionMap {
+		nodes := flattenNodesByState(partition.NodesByState)
+		if len(nodes) <= 0 {
+			continue
+		}
+		nodes = StringsIntersectStrings(nodes, nodes) // Remove dupes.
+		sort.Strings(nodes)
+		seen[strings.Join(nodes, "\x00")] = true
+	}
+	return len(seen)
+}
+
+// Returns the ranked candidateNodes that are within the copyset that
+// best fits the partition, which is the copyset that holds all of the
+// existingNodes and that can fill the most of the constraints with
+// the highest ranked candidates, with ties going to the earlier
+// copyset.  When no copyset can fill the constraints, the
+// candidateNodes are returned unchanged and ok is false.
+func selectCopysetNodes(candidateNodes, existingNodes []string,
+	constraints int, copysets [][]string) (rv []string, ok bool) {
+	if constraints <= 0 {
+		return candidateNodes, true
+	}
+
+	// Keyed by node, value is the node's best rank.
+	ranks := make(map[string]int, len(candidateNodes))
+	for i, node := range candidateNodes {
+		if _, exists := ranks[node]; !exists {
+			ranks[node] = i
+		}
+	}
+
+	bestIdx, bestFilled, bestRankSum := -1, 0, 0
+
+	for i, copyset := range copysets {
+		if len(StringsRemoveStrings(existingNodes, copyset)) > 0 {
+			continue
+		}
+
+		var candidateRanks []int
+		for _, node := range StringsIntersectStrings(copyset, copyset) {
+			if rank, exists := ranks[node]; exists {
+				candidateRanks = append(candidateRanks, rank)
+			}
+		}
+		sort.Ints(candidateRanks)
+		if len(candidateRanks) > constraints {
+			candidateRanks = candidateRanks[:constraints]
+		}
+
+		rankSum := 0
+		for _, rank := range candidateRanks {
+			rankSum += rank
+		}
+
+		if bestIdx < 0 || len(candidateRanks) > bestFilled ||
+			(len(candidateRanks) == bestFilled && rankSum < bestRankSum) {
+			bestIdx, bestFilled, bestRankSum = i, len(candidateRanks), rankSum
+		}
+	}
+
+	if bestIdx < 0 || bestFilled < constraints {
+		return candidateNodes, false
+	}
+
+	members := map[string]bool{}
+	for _, node := range copysets[bestIdx] {
+		members[node] = true
+	}
+
+	for _, node := range candidateNodes {
+		if members[node] {
+			rv = append(rv, node)
+			members[node] = false // Skip dupes.
+		}
+	}
+
+	return rv, true
+}
@@ -0,0 +1,213 @@
+package blance
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestGenerateCopysets(t *testing.T) {
+	nodes := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i"}
+	nodeHierarchy := map[string]string{
+		"a": "r0", "b": "r0", "c": "r0",
+		"d": "r1", "e": "r1", "f": "r1",
+		"g": "r2", "h": "r2", "i": "r2",
+	}
+	tests := []struct {
+		copysetSize     int
+		scatterWidth    int
+		expNumCopysets  int
+		expPerNodeCount int
+	}{
+		{3, 2, 3, 1},
+		{3, 4, 6, 2},
+		{3, 0, 3, 1},
+		{1, 5, 9, 1},
+	}
+	for i, c := range tests {
+		copysets := GenerateCopysets(nodes, c.copysetSize, c.scatterWidth,
+			nodeHierarchy, 1, 1)
+		if len(copysets) != c.expNumCopysets {
+			t.Errorf("i: %d, expNumCopysets: %d, got: %v",
+				i, c.expNumCopysets, copysets)
+		}
+		counts := map[string]int{}
+		for _, copyset := range copysets {
+			if len(copyset) != c.copysetSize {
+				t.Errorf("i: %d, copysetSize: %d, got: %v",
+					i, c.copysetSize, copyset)
+			}
+			racks := map[string]bool{}
+			for _, node := range copyset {
+				counts[node]++
+				racks[nodeHierarchy[node]] = true
+			}
+			if len(racks) != len(copyset) {
+				t.Errorf("i: %d, expected distinct racks, got: %v",
+					i, copyset)
+			}
+		}
+		for _, node := range nodes {
+			if counts[node] != c.expPerNodeCount {
+				t.Errorf("i: %d, node: %s, expPerNodeCount: %d, got: %d",
+					i, node, c.expPerNodeCount, counts[node])
+			}
+		}
+		if !reflect.DeepEqual(copysets, GenerateCopysets(nodes,
+			c.copysetSize, c.scatterWidth, nodeHierarchy, 1, 1)) {
+			t.Errorf("i: %d, expected repeatable copysets", i)
+		}
+	}
+
+	// Wraps around when the nodes don't divide evenly.
+	copysets := GenerateCopysets([]string{"a", "b", "c", "d"}, 3, 2, nil, 0, 1)
+	if len(copysets) != 2 || len(copysets[0]) != 3 || len(copysets[1]) != 3 {
+		t.Errorf("expected 2 copysets of 3 nodes, got: %v", copysets)
+	}
+
+	if GenerateCopysets(nil, 3, 2, nil, 0, 1) != nil {
+		t.Errorf("expected nil copysets for no nodes")
+	}
+}
+
+func TestCountCopysets(t *testing.T) {
+	tests := []struct {
+		m   PartitionMap
+		exp int
+	}{
+		{PartitionMap{}, 0},
+		{
+			PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"primary": {"a"}, "replica": {"b"},
+				}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"primary": {"b"}, "replica": {"a"},
+				}},
+				"2": &Partition{Name: "2", NodesByState: map[string][]string{}},
+			},
+			1,
+		},
+		{
+			PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"primary": {"a"}, "replica": {"b"},
+				}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"primary": {"a"}, "replica": {"c"},
+				}},
+			},
+			2,
+		},
+	}
+	for i, c := range tests {
+		r := CountCopysets(c.m)
+		if r != c.exp {
+			t.Errorf("i: %d, exp: %d, got: %d", i, c.exp, r)
+		}
+	}
+}
+
+func TestSelectCopysetNodes(t *testing.T) {
+	copysets := [][]string{{"a", "b", "c"}, {"d", "e", "f"}, {"a", "e", "g"}}
+	tests := []struct {
+		candidateNodes []string
+		existingNodes  []string
+		constraints    int
+		exp            []string
+		expOk          bool
+	}{
+		{[]string{"d", "a", "e", "b"}, nil, 2, []string{"d", "e"}, true},
+		{[]string{"a", "d", "e", "b"}, nil, 2, []string{"a", "e"}, true},
+		{[]string{"d", "e", "b", "c"}, []string{"a"}, 2,
+			[]string{"b", "c"}, true},
+		{[]string{"d", "e", "b", "c"}, []string{"a"}, 1,
+			[]string{"e"}, true},
+		{[]string{"d", "b"}, []string{"a", "d"}, 1,
+			[]string{"d", "b"}, false},
+		{[]string{"b", "d"}, nil, 2, []string{"b", "d"}, false},
+		{[]string{"b", "d"}, nil, 0, []string{"b", "d"}, true},
+	}
+	for i, c := range tests {
+		r, rOk := selectCopysetNodes(c.candidateNodes, c.existingNodes,
+			c.constraints, copysets)
+		if rOk != c.expOk {
+			t.Errorf("i: %d, expOk: %v, got: %v", i, c.expOk, rOk)
+		}
+		if !reflect.DeepEqual(r, c.exp) {
+			t.Errorf("i: %d, exp: %v, got: %v", i, c.exp, r)
+		}
+	}
+}
+
+func TestPlanNextMapCopysets(t *testing.T) {
+	nodes := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i"}
+	nodeHierarchy := map[string]string{
+		"a": "r0", "b": "r0", "c": "r0",
+		"d": "r1", "e": "r1", "f": "r1",
+		"g": "r2", "h": "r2", "i": "r2",
+	}
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 2,
+		},
+	}
+	prevMap := PartitionMap{}
+	for i := 0; i < 64; i++ {
+		partitionName := fmt.Sprintf("%03d", i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+
+	for _, scatterWidth := range []int{2, 4} {
+		copysets := GenerateCopysets(nodes, 3, scatterWidth,
+			nodeHierarchy, 1, 1)
+
+		r, rWarnings := PlanNextMapDetailed(prevMap, nodes, nil, nil,
+			model, PlanNextMapOptions{
+				NodeHierarchy: nodeHierarchy,
+				NodeWeights:   map[string]int{"a": 2},
+				Copysets:      copysets,
+			})
+		if len(rWarnings) != 0 {
+			t.Errorf("scatterWidth: %d, expected no warnings, got: %v",
+				scatterWidth, rWarnings)
+		}
+		if CountCopysets(r) > len(copysets) {
+			t.Errorf("scatterWidth: %d, expected at most %d copysets,"+
+				" got: %d", scatterWidth, len(copysets), CountCopysets(r))
+		}
+		numPrimaries := map[string]int{}
+		for partitionName, partition := range r {
+			numPrimaries[partition.NodesByState["primary"][0]]++
+			nodes := flattenNodesByState(partition.NodesByState)
+			found := false
+			for _, copyset := range copysets {
+				if len(StringsRemoveStrings(nodes, copyset)) == 0 {
+					found = true
+				}
+			}
+			if !found || len(nodes) != 3 {
+				t.Errorf("scatterWidth: %d, partition: %s,"+
+					" expected nodes within a copyset, got: %v",
+					scatterWidth, partitionName, partition.NodesByState)
+			}
+		}
+		if numPrimaries["a"] <= numPrimaries["b"] {
+			t.Errorf("scatterWidth: %d, expected weighted node a to have"+
+				" more primaries, got: %v", scatterWidth, numPrimaries)
+		}
+	}
+
+	// Without the Copysets, the replica sets are scattered widely.
+	r, _ := PlanNextMapDetailed(prevMap, nodes, nil, nil, model,
+		PlanNextMapOptions{NodeHierarchy: nodeHierarchy})
+	if CountCopysets(r) <= 6 {
+		t.Errorf("expected many copysets, got: %d", CountCopysets(r))
+	}
+}
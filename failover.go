@@ -0,0 +1,216 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"fmt"
+	"sort"
+)
+
+// PlanFailover computes an immediate next map after the failedNodes
+// have failed, without moving any data.  The failedNodes are removed
+// from every partition, and then when a state of a partition has
+// fewer nodes than its constraints (e.g., the primary was on a failed
+// node), the best surviving copy from a lower priority state (e.g., a
+// replica) is promoted, which might cascade to further promotions.
+// No node is assigned a partition that it didn't already have, so
+// CalcPartitionMoves() on the result yields only promote and del
+// ops, leaving the re-replication of the lost copies to a later
+// PlanNextMapEx().
+//
+// The best copy to promote is the one whose promotion best meets the
+// HierarchyRules of the options, and then the one on the node with
+// the least (weighted) partitions already in the promoted state, so
+// that primaries stay balanced.  The options also provide the
+// ModelStateConstraints, PartitionWeights, NodeWeights,
+// StateNodeWeights and NodeHierarchy.  A warning is returned for
+// every partition that was left with no nodes in the top priority
+// state, as there was no surviving copy to promote.
+func PlanFailover(prevMap PartitionMap, failedNodes []string,
+	model PartitionModel, opts PlanNextMapOptions) (
+	nextMap PartitionMap, warnings []string) {
+	nextMap, ws := planFailover(prevMap, failedNodes, model, opts)
+	return nextMap, warningsToStrings(ws)
+}
+
+func planFailover(prevMap PartitionMap, failedNodes []string,
+	model PartitionModel, opts PlanNextMapOptions) (
+	PartitionMap, []*Warning) {
+	var warnings []*Warning
+
+	stateNames := sortStateNames(model)
+	stateConstraints := calcStateConstraints(model, opts)
+
+	nextMap := make(PartitionMap, len(prevMap))
+	partitionNames := make([]string, 0, len(prevMap))
+	for partitionName, partition := range prevMap {
+		nextMap[partitionName] = &Partition{
+			Name: partition.Name,
+			NodesByState: removeNodesFromNodesByState(
+				partition.NodesByState, failedNodes, nil),
+			KeyRange: partition.KeyRange,
+		}
+		partitionNames = append(partitionNames, partitionName)
+	}
+	sort.Strings(partitionNames)
+
+	if len(stateNames) <= 0 {
+		return nextMap, warnings // No states to promote into.
+	}
+
+	stateNodeCounts := countStateNodes(nextMap, opts.PartitionWeights)
+
+	mapChildren := mapParentsToMapChildren(opts.NodeHierarchy)
+
+	for _, partitionName := range partitionNames {
+		nodesByState := nextMap[partitionName].NodesByState
+
+		promoteCopies(partitionName, nodesByState, stateNames,
+			stateConstraints, stateNodeCounts, opts, mapChildren)
+
+		topStateName := stateNames[0]
+		if len(nodesByState[topStateName]) <= 0 &&
+			stateConstraints[topStateName] > 0 {
+			warnings = append(warnings, &Warning{
+				Kind:          WarningFailover,
+				PartitionName: partitionName,
+				StateName:     topStateName,
+				Message: fmt.Sprintf("could not find a copy to"+
+					" promote, stateName: %s, partitionName: %s",
+					topStateName, partitionName),
+			})
+		}
+	}
+
+	return nextMap, warnings
+}
+
+// Promotes the nodes of a partition from lower priority states into
+// the states that have fewer nodes than their constraints, choosing
+// the nodes that best meet the HierarchyRules and then the nodes with
+// the least (weighted) partitions in the promoted state, where nodes
+// with a weight of 0 for the promoted state come last, and updates
+// the stateNodeCounts to match.
+func promoteCopies(partitionName string, nodesByState map[string][]string,
+	stateNames []string, stateConstraints map[string]int,
+	stateNodeCounts map[string]map[string]int, opts PlanNextMapOptions,
+	mapChildren map[string][]string) {
+	partitionWeight := 1
+	if w, exists := opts.PartitionWeights[partitionName]; exists {
+		partitionWeight = w
+	}
+
+	for i, stateName := range stateNames {
+		for len(nodesByState[stateName]) < stateConstraints[stateName] {
+			best, bestStateName := "", ""
+			bestZero, bestScore, bestLoad := false, -1, 0.0
+
+			for _, lowerStateName := range stateNames[i+1:] {
+				for _, node := range nodesByState[lowerStateName] {
+					score := hierarchyRulesScore(node, i,
+						stateNames, nodesByState, opts, mapChildren)
+
+					// A node with a weight of 0 for the state is ranked
+					// last, so it's promoted only when no other copy is
+					// left, as it should receive no new assignments.
+					zero := false
+					load := float64(stateNodeCounts[stateName][node])
+					if w, exists := stateNodeWeight(opts.StateNodeWeights,
+						opts.NodeWeights, stateName, node); exists {
+						if w > 0 {
+							load = load / float64(w)
+						} else {
+							zero = true
+						}
+					}
+
+					if best == "" || (bestZero && !zero) ||
+						(zero == bestZero && (score > bestScore ||
+							(score == bestScore && load < bestLoad))) {
+						best, bestStateName = node, lowerStateName
+						bestZero, bestScore, bestLoad = zero, score, load
+					}
+				}
+			}
+
+			if best == "" {
+				break
+			}
+
+			nodesByState[bestStateName] = StringsRemoveStrings(
+				nodesByState[bestStateName], []string{best})
+			nodesByState[stateName] =
+				append(nodesByState[stateName], best)
+
+			adjustStateNodeCounts(stateNodeCounts, stateName,
+				[]string{best}, partitionWeight)
+			adjustStateNodeCounts(stateNodeCounts, bestStateName,
+				[]string{best}, -partitionWeight)
+		}
+	}
+}
+
+// Returns how well the assignment of the node to the state at
+// stateNames[statei] meets the HierarchyRules, as the number of the
+// rules that are met, where for the top priority state, the rules of
+// the lower priority states are checked relative to the node and
+// counted for each of their nodes, and otherwise, the rules of the
+// state are checked relative to the first node of the top priority
+// state.
+func hierarchyRulesScore(node string, statei int, stateNames []string,
+	nodesByState map[string][]string, opts PlanNextMapOptions,
+	mapChildren map[string][]string) int {
+	if opts.HierarchyRules == nil {
+		return 0
+	}
+
+	score := 0
+
+	if statei == 0 {
+		for _, lowerStateName := range stateNames[1:] {
+			for _, rule := range opts.HierarchyRules[lowerStateName] {
+				if rule.AnchorState != "" &&
+					rule.AnchorState != stateNames[0] {
+					continue
+				}
+				included := StringsToMap(includeExcludeNodes(node,
+					rule.IncludeLevel, rule.ExcludeLevel,
+					opts.NodeHierarchy, mapChildren))
+				for _, n := range nodesByState[lowerStateName] {
+					if n != node && included[n] {
+						score++
+					}
+				}
+			}
+		}
+		return score
+	}
+
+	topNodes := nodesByState[stateNames[0]]
+	if len(topNodes) <= 0 {
+		return 0
+	}
+
+	for _, rule := range opts.HierarchyRules[stateNames[statei]] {
+		if rule.AnchorState != "" && rule.AnchorState != stateNames[0] {
+			continue
+		}
+		included := StringsToMap(includeExcludeNodes(topNodes[0],
+			rule.IncludeLevel, rule.ExcludeLevel,
+			opts.NodeHierarchy, mapChildren))
+		if included[node] {
+			score++
+		}
+	}
+
+	return score
+}
@@ -0,0 +1,259 @@
+package blance
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanFailover(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	tests := []struct {
+		About          string
+		prevMap        PartitionMap
+		failedNodes    []string
+		opts           PlanNextMapOptions
+		exp            PartitionMap
+		expNumWarnings int
+	}{
+		{
+			About: "promote replicas of failed primaries",
+			prevMap: PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"primary": {"a"}, "replica": {"b"},
+				}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"primary": {"a"}, "replica": {"c"},
+				}},
+				"2": &Partition{Name: "2", NodesByState: map[string][]string{
+					"primary": {"b"}, "replica": {"a"},
+				}},
+			},
+			failedNodes: []string{"a"},
+			exp: PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"primary": {"b"}, "replica": {},
+				}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"primary": {"c"}, "replica": {},
+				}},
+				"2": &Partition{Name: "2", NodesByState: map[string][]string{
+					"primary": {"b"}, "replica": {},
+				}},
+			},
+		},
+		{
+			About: "balance the promoted primaries",
+			prevMap: PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"primary": {"a"}, "replica": {"b", "c"},
+				}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"primary": {"a"}, "replica": {"b", "c"},
+				}},
+				"2": &Partition{Name: "2", NodesByState: map[string][]string{
+					"primary": {"b"}, "replica": {"c"},
+				}},
+			},
+			failedNodes: []string{"a"},
+			exp: PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"primary": {"c"}, "replica": {"b"},
+				}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"primary": {"b"}, "replica": {"c"},
+				}},
+				"2": &Partition{Name: "2", NodesByState: map[string][]string{
+					"primary": {"b"}, "replica": {"c"},
+				}},
+			},
+		},
+		{
+			About: "weighted nodes take more primaries",
+			prevMap: PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"primary": {"a"}, "replica": {"c", "b"},
+				}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"primary": {"b"}, "replica": {"c"},
+				}},
+				"2": &Partition{Name: "2", NodesByState: map[string][]string{
+					"primary": {"c"}, "replica": {"b"},
+				}},
+			},
+			failedNodes: []string{"a"},
+			opts:        PlanNextMapOptions{NodeWeights: map[string]int{"b": 2}},
+			exp: PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"primary": {"b"}, "replica": {"c"},
+				}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"primary": {"b"}, "replica": {"c"},
+				}},
+				"2": &Partition{Name: "2", NodesByState: map[string][]string{
+					"primary": {"c"}, "replica": {"b"},
+				}},
+			},
+		},
+		{
+			About: "the hierarchy outranks balance",
+			prevMap: PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"primary": {"a"}, "replica": {"b", "c", "d"},
+				}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"primary": {"b"}, "replica": {"c"},
+				}},
+			},
+			failedNodes: []string{"a"},
+			opts: PlanNextMapOptions{
+				NodeHierarchy: map[string]string{
+					"a": "r0", "b": "r0", "c": "r1", "d": "r1",
+					"r0": "z", "r1": "z",
+				},
+				HierarchyRules: HierarchyRules{
+					"replica": []*HierarchyRule{
+						{IncludeLevel: 2, ExcludeLevel: 1},
+					},
+				},
+			},
+			exp: PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"primary": {"b"}, "replica": {"c", "d"},
+				}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"primary": {"b"}, "replica": {"c"},
+				}},
+			},
+		},
+		{
+			About: "no surviving copies",
+			prevMap: PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"primary": {"a"}, "replica": {"b"},
+				}},
+			},
+			failedNodes: []string{"a", "b"},
+			exp: PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"primary": {}, "replica": {},
+				}},
+			},
+			expNumWarnings: 1,
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanFailover(c.prevMap, c.failedNodes, model, c.opts)
+		if !reflect.DeepEqual(r, c.exp) {
+			t.Errorf("i: %d, about: %s, exp: %v, got: %v",
+				i, c.About, c.exp, r)
+		}
+		if len(rWarnings) != c.expNumWarnings {
+			t.Errorf("i: %d, about: %s, expNumWarnings: %d, got: %v",
+				i, c.About, c.expNumWarnings, rWarnings)
+		}
+		for partitionName, partition := range r {
+			moves := CalcPartitionMoves([]string{"primary", "replica"},
+				c.prevMap[partitionName].NodesByState,
+				partition.NodesByState, false)
+			for _, move := range moves {
+				if move.Op == "add" || move.Op == "demote" {
+					t.Errorf("i: %d, about: %s, unexpected move: %+v",
+						i, c.About, move)
+				}
+			}
+		}
+	}
+}
+
+func TestPlanFailoverCascade(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+		"standby": &PartitionModelState{
+			Priority: 2, Constraints: 2,
+		},
+	}
+	prevMap := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{
+			"primary": {"a"}, "replica": {"b"}, "standby": {"c", "d"},
+		}},
+	}
+	r, rWarnings := PlanFailover(prevMap, []string{"a"}, model,
+		PlanNextMapOptions{})
+	exp := map[string][]string{
+		"primary": {"b"}, "replica": {"c"}, "standby": {"d"},
+	}
+	if !reflect.DeepEqual(r["0"].NodesByState, exp) || len(rWarnings) != 0 {
+		t.Errorf("exp: %v, got: %v, warnings: %v",
+			exp, r["0"].NodesByState, rWarnings)
+	}
+	if !reflect.DeepEqual(prevMap["0"].NodesByState["primary"],
+		[]string{"a"}) {
+		t.Errorf("expected prevMap to be unchanged, got: %v", prevMap)
+	}
+}
+
+func TestPlanFailoverEmptyModel(t *testing.T) {
+	prevMap := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{
+			"primary": {"a"}, "replica": {"b"},
+		}},
+	}
+	r, rWarnings := PlanFailover(prevMap, []string{"a"}, PartitionModel{},
+		PlanNextMapOptions{})
+	exp := map[string][]string{"primary": {}, "replica": {"b"}}
+	if !reflect.DeepEqual(r["0"].NodesByState, exp) || len(rWarnings) != 0 {
+		t.Errorf("exp: %v, got: %v, warnings: %v",
+			exp, r["0"].NodesByState, rWarnings)
+	}
+}
+
+func TestPlanFailoverZeroWeight(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 2,
+		},
+	}
+	opts := PlanNextMapOptions{
+		StateNodeWeights: map[string]map[string]int{
+			"primary": {"b": 0},
+		},
+	}
+	tests := []struct {
+		replicas   []string
+		expPrimary []string
+	}{
+		{[]string{"b", "c"}, []string{"c"}},
+		{[]string{"c", "b"}, []string{"c"}},
+		// The zero weight node is still promoted when it's the only
+		// copy left.
+		{[]string{"b"}, []string{"b"}},
+	}
+	for i, c := range tests {
+		prevMap := PartitionMap{
+			"0": &Partition{Name: "0", NodesByState: map[string][]string{
+				"primary": {"a"}, "replica": c.replicas,
+			}},
+		}
+		r, _ := PlanFailover(prevMap, []string{"a"}, model, opts)
+		if !reflect.DeepEqual(r["0"].NodesByState["primary"],
+			c.expPrimary) {
+			t.Errorf("i: %d, expPrimary: %v, got: %v",
+				i, c.expPrimary, r["0"].NodesByState)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"sort"
+)
+
+// PlanNewPartitions assigns the new partitions of the prevMap, which
+// are the partitions with no nodes in any state (e.g., after the
+// partition count was increased), while leaving the assignments of the
+// existing partitions as is.  The new partitions are placed to fill
+// up the underloaded nodes, as the existing partitions still count
+// towards the load of their nodes.  The nodesAll may include newly
+// added nodes.
+//
+// When the options have a BalanceTolerance and, after placing the
+// new partitions, some node is still outside of the BalanceTolerance
+// of its fair share, then existing partitions are moved only until
+// every node is within the BalanceTolerance.  Without a
+// BalanceTolerance, the existing partitions are never moved.
+func PlanNewPartitions(prevMap PartitionMap, nodesAll []string,
+	model PartitionModel, opts PlanNextMapOptions) (
+	nextMap PartitionMap, warnings []string) {
+	nextMap, ws := planNewPartitions(prevMap, nodesAll, model, opts)
+	return nextMap, warningsToStrings(ws)
+}
+
+func planNewPartitions(prevMap PartitionMap, nodesAll []string,
+	model PartitionModel, opts PlanNextMapOptions) (
+	PartitionMap, []*Warning) {
+	newPartitions := []string{}
+	for partitionName, partition := range prevMap {
+		if len(flattenNodesByState(partition.NodesByState)) <= 0 {
+			newPartitions = append(newPartitions, partitionName)
+		}
+	}
+	sort.Strings(newPartitions)
+
+	scopedOpts := opts
+	scopedOpts.ScopePartitions = newPartitions
+	if opts.ScopePartitions != nil {
+		scopedOpts.ScopePartitions =
+			StringsIntersectStrings(newPartitions, opts.ScopePartitions)
+	}
+	scopedOpts.BalanceTolerance = 0
+
+	nextMap, warnings := planNextMapEx(prevMap, nodesAll, nil, nil,
+		model, scopedOpts)
+
+	if opts.BalanceTolerance > 0 {
+		// The prevMap is returned as is when every node is already
+		// within the BalanceTolerance.
+		var balanceWarnings []*Warning
+		nextMap, balanceWarnings = planNextMapEx(nextMap, nodesAll, nil, nil,
+			model, opts)
+
+		// Both passes may warn about the same partition, such as one
+		// that can't meet the constraints, so repeats are skipped.
+		seen := map[Warning]bool{}
+		for _, w := range warnings {
+			seen[*w] = true
+		}
+		for _, w := range balanceWarnings {
+			if !seen[*w] {
+				seen[*w] = true
+				warnings = append(warnings, w)
+			}
+		}
+	}
+
+	return nextMap, warnings
+}
@@ -0,0 +1,179 @@
+package blance
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestPlanNewPartitions(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+
+	// Returns a map of numPartitions, where the partitions from
+	// fromMap are kept and the rest are new and empty.
+	grow := func(fromMap PartitionMap, numPartitions int) PartitionMap {
+		rv := PartitionMap{}
+		for i := 0; i < numPartitions; i++ {
+			partitionName := fmt.Sprintf("%03d", i)
+			rv[partitionName] = &Partition{
+				Name:         partitionName,
+				NodesByState: map[string][]string{},
+			}
+			if p, exists := fromMap[partitionName]; exists {
+				rv[partitionName] = p
+			}
+		}
+		return rv
+	}
+
+	prevMap, _ := PlanNextMapEx(grow(nil, 64), []string{"a", "b", "c"},
+		nil, nil, model, PlanNextMapOptions{})
+
+	tests := []struct {
+		About            string
+		NumPartitions    int
+		Nodes            []string
+		BalanceTolerance float64
+		expExistingMoved bool
+		expMinLoad       float64
+		expMaxLoad       float64
+	}{
+		{
+			About:         "64 to 128 partitions",
+			NumPartitions: 128,
+			Nodes:         []string{"a", "b", "c"},
+			expMinLoad:    85,
+			expMaxLoad:    86,
+		},
+		{
+			About:         "64 to 128 partitions, add a node",
+			NumPartitions: 128,
+			Nodes:         []string{"a", "b", "c", "d"},
+			expMinLoad:    64,
+			expMaxLoad:    64,
+		},
+		{
+			About:         "64 to 72 partitions, add a node",
+			NumPartitions: 72,
+			Nodes:         []string{"a", "b", "c", "d"},
+			expMinLoad:    8,
+			expMaxLoad:    46,
+		},
+		{
+			About:            "64 to 72 partitions, add a node, tolerance",
+			NumPartitions:    72,
+			Nodes:            []string{"a", "b", "c", "d"},
+			BalanceTolerance: 0.1,
+			expExistingMoved: true,
+			expMinLoad:       31,
+			expMaxLoad:       37,
+		},
+		{
+			About:            "64 to 128 partitions, add a node, tolerance",
+			NumPartitions:    128,
+			Nodes:            []string{"a", "b", "c", "d"},
+			BalanceTolerance: 0.1,
+			expMinLoad:       64,
+			expMaxLoad:       64,
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanNewPartitions(grow(prevMap, c.NumPartitions),
+			c.Nodes, model, PlanNextMapOptions{
+				BalanceTolerance: c.BalanceTolerance,
+			})
+		if len(rWarnings) != 0 {
+			t.Errorf("i: %d, about: %s, expected no warnings, got: %v",
+				i, c.About, rWarnings)
+		}
+		if len(r) != c.NumPartitions {
+			t.Errorf("i: %d, about: %s, expected %d partitions, got: %d",
+				i, c.About, c.NumPartitions, len(r))
+		}
+
+		existingMoved := false
+		for partitionName, partition := range r {
+			if len(partition.NodesByState["primary"]) != 1 ||
+				len(partition.NodesByState["replica"]) != 1 {
+				t.Errorf("i: %d, about: %s, partition: %s,"+
+					" expected assigned, got: %v",
+					i, c.About, partitionName, partition.NodesByState)
+			}
+			if p, exists := prevMap[partitionName]; exists &&
+				!reflect.DeepEqual(p, partition) {
+				existingMoved = true
+			}
+		}
+		if existingMoved != c.expExistingMoved {
+			t.Errorf("i: %d, about: %s, expExistingMoved: %v, got: %v",
+				i, c.About, c.expExistingMoved, existingMoved)
+		}
+
+		for _, node := range c.Nodes {
+			load := countNodeLoads(countStateNodes(r, nil), nil)[node]
+			if load < c.expMinLoad || load > c.expMaxLoad {
+				t.Errorf("i: %d, about: %s, node: %s, load: %v,"+
+					" expected between %v and %v",
+					i, c.About, node, load, c.expMinLoad, c.expMaxLoad)
+			}
+		}
+	}
+}
+
+func TestPlanNewPartitionsWarnings(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	prevMap := PartitionMap{}
+	for i := 0; i < 8; i++ {
+		partitionName := fmt.Sprintf("%d", i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+	prevMap, _ = PlanNextMapEx(prevMap, []string{"a", "b", "c"},
+		nil, nil, model, PlanNextMapOptions{})
+	prevMap["8"] = &Partition{
+		Name:         "8",
+		NodesByState: map[string][]string{},
+	}
+
+	for _, balanceTolerance := range []float64{0, 0.1} {
+		_, rWarnings := planNewPartitions(prevMap,
+			[]string{"a", "b", "c", "d"}, model, PlanNextMapOptions{
+				NodeLabels: map[string]map[string]string{
+					"a": {"disk": "ssd"},
+				},
+				PartitionNodeSelectors: map[string]map[string]string{
+					"8": {"disk": "ssd"},
+				},
+				BalanceTolerance: balanceTolerance,
+			})
+		seen := map[Warning]bool{}
+		for _, w := range rWarnings {
+			if w.Kind != WarningNodeSelectors || w.PartitionName != "8" ||
+				w.StateName != "replica" || seen[*w] {
+				t.Errorf("balanceTolerance: %v, unexpected warning: %#v",
+					balanceTolerance, w)
+			}
+			seen[*w] = true
+		}
+		if len(rWarnings) != 1 {
+			t.Errorf("balanceTolerance: %v, expected 1 warning, got: %v",
+				balanceTolerance, warningsToStrings(rWarnings))
+		}
+	}
+}
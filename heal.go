@@ -0,0 +1,322 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"fmt"
+	"sort"
+)
+
+// PlanHealing computes a next map that restores the missing copies
+// of the under-replicated partitions of the prevMap, which are the
+// partitions that have a state with fewer nodes than its constraints,
+// while the other, healthy partitions are left as is.  Copies on
+// nodes that are not in nodesAll are treated as lost.
+//
+// The under-replicated partitions are healed in the order of their
+// returned ranks, which are keyed by partitionName, where rank 0 is
+// healed first.  The partitions with the fewest remaining copies come
+// first (e.g., 0 copies, then 1 copy, then 2 copies), with ties
+// ordered by partitionName.  An orchestrator can follow the same
+// order, such as with RankedPartitionMoveForNode().
+//
+// A missing copy of a higher priority state is first restored by
+// promoting a remaining copy, as in PlanFailover(), and then the
+// missing copies of the lower priority states are added to the nodes
+// that best meet the HierarchyRules of the options, and then to the
+// nodes with the least weighted load.  The options also provide the
+// ModelStateConstraints, PartitionWeights, StateLoadFactor,
+// NodeWeights, StateNodeWeights and NodeHierarchy, where nodes with a
+// weight of 0 are not assigned any new copies.  The NodeLabels with
+// the StateNodeSelectors and PartitionNodeSelectors, the NodeTaints
+// (NoSchedule) with the PartitionTolerations, the Copysets, the
+// DomainStateQuotas and the SpreadRules are honored the same as by
+// the planner, while the other options are ignored.  A warning is
+// returned for every partition state that could not be fully
+// restored, or that could not meet the Copysets, DomainStateQuotas or
+// SpreadRules.
+func PlanHealing(prevMap PartitionMap, nodesAll []string,
+	model PartitionModel, opts PlanNextMapOptions) (
+	nextMap PartitionMap, ranks map[string]int, warnings []string) {
+	nextMap, ranks, ws := planHealing(prevMap, nodesAll, model, opts)
+	return nextMap, ranks, warningsToStrings(ws)
+}
+
+func planHealing(prevMap PartitionMap, nodesAll []string,
+	model PartitionModel, opts PlanNextMapOptions) (
+	PartitionMap, map[string]int, []*Warning) {
+	var warnings []*Warning
+
+	stateNames := sortStateNames(model)
+	stateConstraints := calcStateConstraints(model, opts)
+
+	nodesAll = append([]string(nil), nodesAll...)
+	sort.Strings(nodesAll)
+
+	nodesAllMap := StringsToMap(nodesAll)
+
+	nextMap := make(PartitionMap, len(prevMap))
+
+	// Keyed by partitionName, value is the number of copies.
+	numCopies := map[string]int{}
+
+	var unhealthy []string
+	for partitionName, partition := range prevMap {
+		nodesByState := make(map[string][]string)
+		for stateName, nodes := range partition.NodesByState {
+			nodesByState[stateName] = []string{}
+			for _, node := range nodes {
+				if nodesAllMap[node] {
+					nodesByState[stateName] =
+						append(nodesByState[stateName], node)
+				}
+			}
+		}
+		nextMap[partitionName] = &Partition{
+			Name:         partition.Name,
+			NodesByState: nodesByState,
+			KeyRange:     partition.KeyRange,
+		}
+
+		copies := flattenNodesByState(nodesByState)
+		numCopies[partitionName] =
+			len(StringsIntersectStrings(copies, copies))
+
+		for stateName, constraints := range stateConstraints {
+			if len(nodesByState[stateName]) < constraints {
+				unhealthy = append(unhealthy, partitionName)
+				break
+			}
+		}
+	}
+
+	sort.Slice(unhealthy, func(i, j int) bool {
+		if numCopies[unhealthy[i]] != numCopies[unhealthy[j]] {
+			return numCopies[unhealthy[i]] < numCopies[unhealthy[j]]
+		}
+		return unhealthy[i] < unhealthy[j]
+	})
+
+	ranks := make(map[string]int, len(unhealthy))
+	for rank, partitionName := range unhealthy {
+		ranks[partitionName] = rank
+	}
+
+	stateNodeCounts := countStateNodes(nextMap, opts.PartitionWeights)
+
+	mapChildren := mapParentsToMapChildren(opts.NodeHierarchy)
+
+	for _, partitionName := range unhealthy {
+		partition := nextMap[partitionName]
+		nodesByState := partition.NodesByState
+
+		promoteCopies(partitionName, nodesByState, stateNames,
+			stateConstraints, stateNodeCounts, opts, mapChildren)
+
+		partitionWeight := 1
+		if w, exists := opts.PartitionWeights[partitionName]; exists {
+			partitionWeight = w
+		}
+
+		for i, stateName := range stateNames {
+			missing := stateConstraints[stateName] -
+				len(nodesByState[stateName])
+			if missing <= 0 {
+				continue
+			}
+
+			nodeLoads := countNodeLoads(stateNodeCounts,
+				opts.StateLoadFactor)
+
+			holders := StringsToMap(flattenNodesByState(nodesByState))
+
+			// Keyed by node, the values rank the candidate nodes.
+			scores := map[string]int{}
+			loads := map[string]float64{}
+
+			var candidateNodes []string
+			for _, node := range nodesAll {
+				w, exists := stateNodeWeight(opts.StateNodeWeights,
+					opts.NodeWeights, stateName, node)
+				if (exists && w <= 0) || holders[node] ||
+					!nodeSelected(opts, partitionName, stateName, node) ||
+					nodeTainted(opts, partitionName, node) {
+					continue
+				}
+
+				scores[node] = hierarchyRulesScore(node, i,
+					stateNames, nodesByState, opts, mapChildren)
+
+				loads[node] = nodeLoads[node]
+				if exists {
+					loads[node] = loads[node] / float64(w)
+				}
+
+				candidateNodes = append(candidateNodes, node)
+			}
+
+			// The nodesAll are sorted, so ties go to the node name.
+			sort.SliceStable(candidateNodes, func(i, j int) bool {
+				a, b := candidateNodes[i], candidateNodes[j]
+				if scores[a] != scores[b] {
+					return scores[a] > scores[b]
+				}
+				return loads[a] < loads[b]
+			})
+
+			candidateNodes, ws := selectHealingNodes(partitionName,
+				stateName, candidateNodes, missing,
+				stateNames[i+1:], stateConstraints, nodesByState, opts)
+			warnings = append(warnings, ws...)
+
+			if len(candidateNodes) > missing {
+				candidateNodes = candidateNodes[:missing]
+			}
+			if len(candidateNodes) < missing {
+				warnings = append(warnings, &Warning{
+					Kind:          WarningHealing,
+					PartitionName: partitionName,
+					StateName:     stateName,
+					Message: fmt.Sprintf("could not restore %d"+
+						" copies, stateName: %s, partitionName: %s",
+						missing-len(candidateNodes),
+						stateName, partitionName),
+				})
+			}
+
+			nodesByState[stateName] =
+				append(nodesByState[stateName], candidateNodes...)
+
+			adjustStateNodeCounts(stateNodeCounts, stateName,
+				candidateNodes, partitionWeight)
+		}
+	}
+
+	return nextMap, ranks, warnings
+}
+
+// Narrows the ranked candidateNodes for the missing copies of a state
+// of a partition to those that keep the partition within the
+// Copysets, DomainStateQuotas and SpreadRules of the options, the same
+// as the planner, where the copies that the partition already has
+// count towards the quotas and spread rules.  The lowerStateNames are
+// the states that are yet to be restored.
+func selectHealingNodes(partitionName, stateName string,
+	candidateNodes []string, missing int, lowerStateNames []string,
+	stateConstraints map[string]int, nodesByState map[string][]string,
+	opts PlanNextMapOptions) ([]string, []*Warning) {
+	var warnings []*Warning
+
+	existingNodes := flattenNodesByState(nodesByState)
+
+	remainingCopies := 0
+	for _, lowerStateName := range lowerStateNames {
+		if n := stateConstraints[lowerStateName] -
+			len(nodesByState[lowerStateName]); n > 0 {
+			remainingCopies += n
+		}
+	}
+
+	if len(opts.Copysets) > 0 {
+		var copysetOk bool
+		candidateNodes, copysetOk = selectCopysetNodes(candidateNodes,
+			existingNodes, missing, opts.Copysets)
+		if !copysetOk {
+			warnings = append(warnings, &Warning{
+				Kind:          WarningCopysets,
+				PartitionName: partitionName,
+				StateName:     stateName,
+				Message: fmt.Sprintf("could not fit copies into a"+
+					" copyset, stateName: %s, partitionName: %s",
+					stateName, partitionName),
+			})
+		}
+	}
+
+	if opts.DomainStateQuotas != nil {
+		quotas := make(map[string]int) // Keyed by domain.
+		for domain, stateQuotas := range opts.DomainStateQuotas {
+			if quota, exists := stateQuotas[stateName]; exists {
+				quotas[domain] = quota
+			}
+		}
+		for _, node := range nodesByState[stateName] {
+			for _, domain := range ancestors(node, opts.NodeHierarchy) {
+				if quota, exists := quotas[domain]; exists && quota > 0 {
+					quotas[domain] = quota - 1
+				}
+			}
+		}
+		if len(quotas) > 0 {
+			var shortDomains []string
+			candidateNodes, shortDomains = selectQuotaNodes(
+				candidateNodes, missing, quotas, opts.NodeHierarchy)
+			for _, domain := range shortDomains {
+				warnings = append(warnings, &Warning{
+					Kind:          WarningDomainQuotas,
+					PartitionName: partitionName,
+					StateName:     stateName,
+					Message: fmt.Sprintf("could not meet domain"+
+						" quota: %d, domain: %s, stateName: %s,"+
+						" partitionName: %s",
+						opts.DomainStateQuotas[domain][stateName], domain,
+						stateName, partitionName),
+				})
+			}
+		}
+	}
+
+	if len(opts.SpreadRules) > 0 {
+		var spreadOk bool
+		candidateNodes, spreadOk = selectSpreadNodes(candidateNodes,
+			existingNodes, missing, remainingCopies,
+			opts.SpreadRules, opts.NodeHierarchy)
+		if !spreadOk {
+			warnings = append(warnings, &Warning{
+				Kind:          WarningSpreadRules,
+				PartitionName: partitionName,
+				StateName:     stateName,
+				Message: fmt.Sprintf("could not meet spread rules,"+
+					" stateName: %s, partitionName: %s",
+					stateName, partitionName),
+			})
+		}
+	}
+
+	return candidateNodes, warnings
+}
+
+// RankedPartitionMoveForNode returns a FindMoveFunc that favors the
+// moves of the partitions with the lowest ranks, such as from
+// PlanHealing(), where moves of unranked partitions come last, and
+// otherwise falls back to the lowest MoveOpWeight.
+func RankedPartitionMoveForNode(ranks map[string]int) FindMoveFunc {
+	rankOf := func(partition string) int {
+		rank, exists := ranks[partition]
+		if !exists {
+			return int(^uint(0) >> 1) // Unranked partitions come last.
+		}
+		return rank
+	}
+
+	return func(node string, moves []PartitionMove) int {
+		r := 0
+		for i, move := range moves {
+			ri, rr := rankOf(move.Partition), rankOf(moves[r].Partition)
+			if ri < rr || (ri == rr &&
+				MoveOpWeight[moves[r].Op] > MoveOpWeight[move.Op]) {
+				r = i
+			}
+		}
+		return r
+	}
+}
@@ -0,0 +1,253 @@
+package blance
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanHealing(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 2,
+		},
+	}
+	prevMap := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{
+			"primary": {}, "replica": {},
+		}},
+		"1": &Partition{Name: "1", NodesByState: map[string][]string{
+			"primary": {"b"}, "replica": {},
+		}},
+		"2": &Partition{Name: "2", NodesByState: map[string][]string{
+			"primary": {}, "replica": {"c", "d"},
+		}},
+		"3": &Partition{Name: "3", NodesByState: map[string][]string{
+			"primary": {"a"}, "replica": {"b", "c"},
+		}},
+		"4": &Partition{Name: "4", NodesByState: map[string][]string{
+			"primary": {"x"}, "replica": {"b", "c"},
+		}},
+	}
+	nodesAll := []string{"a", "b", "c", "d"}
+
+	r, ranks, warnings := PlanHealing(prevMap, nodesAll, model,
+		PlanNextMapOptions{})
+	if len(warnings) != 0 {
+		t.Errorf("expected no warnings, got: %v", warnings)
+	}
+	expRanks := map[string]int{"0": 0, "1": 1, "2": 2, "4": 3}
+	if !reflect.DeepEqual(ranks, expRanks) {
+		t.Errorf("expRanks: %v, got: %v", expRanks, ranks)
+	}
+	if !reflect.DeepEqual(r["3"], prevMap["3"]) {
+		t.Errorf("expected healthy partition to be unchanged, got: %v",
+			r["3"].NodesByState)
+	}
+	for partitionName, partition := range r {
+		primaries := partition.NodesByState["primary"]
+		replicas := partition.NodesByState["replica"]
+		nodes := flattenNodesByState(partition.NodesByState)
+		if len(primaries) != 1 || len(replicas) != 2 ||
+			len(StringsIntersectStrings(nodes, nodes)) != 3 ||
+			len(StringsRemoveStrings(nodes, nodesAll)) != 0 {
+			t.Errorf("partition: %s, expected healed, got: %v",
+				partitionName, partition.NodesByState)
+		}
+		prevNodes := StringsIntersectStrings(
+			flattenNodesByState(prevMap[partitionName].NodesByState),
+			nodesAll)
+		if len(StringsRemoveStrings(prevNodes, nodes)) != 0 {
+			t.Errorf("partition: %s, expected remaining copies to be"+
+				" kept, prevNodes: %v, got: %v",
+				partitionName, prevNodes, partition.NodesByState)
+		}
+	}
+	if r["1"].NodesByState["primary"][0] != "b" {
+		t.Errorf("expected primary to stay, got: %v", r["1"].NodesByState)
+	}
+	if p := r["2"].NodesByState["primary"][0]; p != "c" && p != "d" {
+		t.Errorf("expected a replica to be promoted, got: %v",
+			r["2"].NodesByState)
+	}
+
+	// Not enough nodes to restore every copy.
+	_, _, warnings = PlanHealing(prevMap, []string{"a", "b"}, model,
+		PlanNextMapOptions{})
+	if len(warnings) != 5 {
+		t.Errorf("expected a warning per partition, got: %v", warnings)
+	}
+
+	// Zero weight nodes are not given new copies.
+	r, _, _ = PlanHealing(PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{
+			"primary": {"a"}, "replica": {"b"},
+		}},
+	}, nodesAll, model, PlanNextMapOptions{
+		NodeWeights: map[string]int{"c": 0},
+	})
+	if !reflect.DeepEqual(r["0"].NodesByState["replica"],
+		[]string{"b", "d"}) {
+		t.Errorf("expected replica on d, got: %v", r["0"].NodesByState)
+	}
+}
+
+func TestRankedPartitionMoveForNode(t *testing.T) {
+	findMove := RankedPartitionMoveForNode(map[string]int{"0": 0, "1": 1})
+	tests := []struct {
+		moves []PartitionMove
+		exp   int
+	}{
+		{[]PartitionMove{{Partition: "1", Op: "add"}}, 0},
+		{[]PartitionMove{
+			{Partition: "x", Op: "promote"},
+			{Partition: "1", Op: "add"},
+			{Partition: "0", Op: "del"},
+			{Partition: "0", Op: "add"},
+		}, 3},
+		{[]PartitionMove{
+			{Partition: "x", Op: "del"},
+			{Partition: "y", Op: "promote"},
+		}, 1},
+	}
+	for i, c := range tests {
+		r := findMove("a", c.moves)
+		if r != c.exp {
+			t.Errorf("i: %d, exp: %d, got: %d", i, c.exp, r)
+		}
+	}
+}
+
+func TestPlanHealingZeroWeight(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 2,
+		},
+	}
+	prevMap := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{
+			"primary": {}, "replica": {"b", "c"},
+		}},
+	}
+	r, _, _ := PlanHealing(prevMap, []string{"b", "c", "d"}, model,
+		PlanNextMapOptions{
+			StateNodeWeights: map[string]map[string]int{
+				"primary": {"b": 0},
+			},
+		})
+	if !reflect.DeepEqual(r["0"].NodesByState["primary"], []string{"c"}) {
+		t.Errorf("expected c promoted to primary, got: %v",
+			r["0"].NodesByState)
+	}
+}
+
+func TestPlanHealingRules(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	nodeHierarchy := map[string]string{
+		"a": "dc1", "b": "dc1", "c": "dc2", "d": "dc2",
+	}
+	tests := []struct {
+		About      string
+		NodesAll   []string
+		Opts       PlanNextMapOptions
+		expReplica []string
+	}{
+		{
+			About:    "NoSchedule taint",
+			NodesAll: []string{"a", "c", "d"},
+			Opts: PlanNextMapOptions{
+				NodeTaints: map[string][]Taint{
+					"c": {{Key: "k", Effect: TaintNoSchedule}},
+				},
+			},
+			expReplica: []string{"d"},
+		},
+		{
+			About:    "state node selector",
+			NodesAll: []string{"a", "c", "d"},
+			Opts: PlanNextMapOptions{
+				NodeLabels: map[string]map[string]string{
+					"d": {"disk": "ssd"},
+				},
+				StateNodeSelectors: map[string]map[string]string{
+					"replica": {"disk": "ssd"},
+				},
+			},
+			expReplica: []string{"d"},
+		},
+		{
+			About:    "spread rule",
+			NodesAll: []string{"a", "b", "c"},
+			Opts: PlanNextMapOptions{
+				NodeHierarchy: nodeHierarchy,
+				SpreadRules:   []*SpreadRule{{Level: 1, MaxPerDomain: 1}},
+			},
+			expReplica: []string{"c"},
+		},
+		{
+			About:    "domain state quota",
+			NodesAll: []string{"a", "b", "c"},
+			Opts: PlanNextMapOptions{
+				NodeHierarchy: nodeHierarchy,
+				DomainStateQuotas: map[string]map[string]int{
+					"dc2": {"replica": 1},
+				},
+			},
+			expReplica: []string{"c"},
+		},
+		{
+			About:    "copysets",
+			NodesAll: []string{"a", "b", "c"},
+			Opts: PlanNextMapOptions{
+				Copysets: [][]string{{"a", "c"}},
+			},
+			expReplica: []string{"c"},
+		},
+	}
+	for i, c := range tests {
+		prevMap := PartitionMap{
+			"0": &Partition{Name: "0", NodesByState: map[string][]string{
+				"primary": {"a"}, "replica": {},
+			}},
+		}
+		r, _, warnings := PlanHealing(prevMap, c.NodesAll, model, c.Opts)
+		if len(warnings) != 0 {
+			t.Errorf("i: %d, about: %s, expected no warnings, got: %v",
+				i, c.About, warnings)
+		}
+		if !reflect.DeepEqual(r["0"].NodesByState["replica"],
+			c.expReplica) {
+			t.Errorf("i: %d, about: %s, expReplica: %v, got: %v",
+				i, c.About, c.expReplica, r["0"].NodesByState)
+		}
+	}
+
+	// A rule that can't be met is reported, along with the copy that
+	// couldn't be restored.
+	prevMap := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{
+			"primary": {"a"}, "replica": {},
+		}},
+	}
+	r, _, warnings := PlanHealing(prevMap, []string{"a", "b"}, model,
+		PlanNextMapOptions{
+			NodeHierarchy: nodeHierarchy,
+			SpreadRules:   []*SpreadRule{{Level: 1, MaxPerDomain: 1}},
+		})
+	if len(r["0"].NodesByState["replica"]) != 0 || len(warnings) != 2 {
+		t.Errorf("expected an unrestored replica and warnings,"+
+			" got: %v, warnings: %v", r["0"].NodesByState, warnings)
+	}
+}
@@ -0,0 +1,206 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// NodeHierarchyFromPaths builds a NodeHierarchy, which is keyed by
+// node where a value is the node's parent, from path strings that
+// list the ancestors of each node from the top down, separated by
+// "/", like "dc1/rowA/rack3/node7".  The names of the nodes and their
+// ancestors must be unique across the whole hierarchy, and the result
+// is checked with ValidateNodeHierarchy().
+func NodeHierarchyFromPaths(paths []string) (map[string]string, error) {
+	rv := map[string]string{}
+	roots := map[string]bool{}
+	nodes := make([]string, 0, len(paths))
+	nodeDepths := make(map[string]int, len(paths))
+	for _, path := range paths {
+		parts := strings.Split(path, "/")
+		if err := addHierarchyPath(rv, roots, parts); err != nil {
+			return nil, fmt.Errorf("path: %q, %v", path, err)
+		}
+		node := parts[len(parts)-1]
+		nodes = append(nodes, node)
+		nodeDepths[node] = len(parts) - 1
+	}
+	if err := ValidateNodeHierarchy(rv, nodes); err != nil {
+		return nil, err
+	}
+	if err := checkHierarchyDepths(rv, nodeDepths); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// NodeHierarchyFromLabels builds a NodeHierarchy from the topology
+// labels of each node, such as the NodeLabels of the
+// PlanNextMapOptions.  The labelKeys list the label keys from the top
+// down, like ["region", "zone", "rack"], so a node labeled
+// {"region": "us", "zone": "us-1a", "rack": "r7"} has an ancestry of
+// "us/us-1a/r7".  Every node must have every label key, the label
+// values must be unique across the whole hierarchy, and the result is
+// checked with ValidateNodeHierarchy().
+func NodeHierarchyFromLabels(nodeLabels map[string]map[string]string,
+	labelKeys []string) (map[string]string, error) {
+	nodes := make([]string, 0, len(nodeLabels))
+	for node := range nodeLabels {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	rv := map[string]string{}
+	roots := map[string]bool{}
+	nodeDepths := make(map[string]int, len(nodes))
+	for _, node := range nodes {
+		parts := make([]string, 0, len(labelKeys)+1)
+		for _, labelKey := range labelKeys {
+			labelValue := nodeLabels[node][labelKey]
+			if labelValue == "" {
+				return nil, fmt.Errorf("node: %q, missing label: %q",
+					node, labelKey)
+			}
+			parts = append(parts, labelValue)
+		}
+		parts = append(parts, node)
+		if err := addHierarchyPath(rv, roots, parts); err != nil {
+			return nil, fmt.Errorf("node: %q, %v", node, err)
+		}
+		nodeDepths[node] = len(labelKeys)
+	}
+	if err := ValidateNodeHierarchy(rv, nodes); err != nil {
+		return nil, err
+	}
+	if err := checkHierarchyDepths(rv, nodeDepths); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// ValidateNodeHierarchy returns an error if the nodeHierarchy, which
+// is keyed by node where a value is the node's parent, has a cycle,
+// has one of the nodes as the parent of another node, or has nodes
+// at different depths.  The nodes are the leaves of the hierarchy;
+// when nil, the nodes are those that are not a parent of any node.
+func ValidateNodeHierarchy(nodeHierarchy map[string]string,
+	nodes []string) error {
+	children := map[string]string{} // Keyed by parent, value is a child.
+	for child, parent := range nodeHierarchy {
+		if parent != "" {
+			children[parent] = child
+		}
+	}
+
+	if nodes == nil {
+		nodes = make([]string, 0, len(nodeHierarchy))
+		for node := range nodeHierarchy {
+			if _, exists := children[node]; !exists {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+	nodes = append([]string(nil), nodes...)
+	sort.Strings(nodes)
+
+	// Returns the number of ancestors of the node.
+	depth := func(node string) (int, error) {
+		seen := map[string]bool{}
+		d := 0
+		for {
+			if seen[node] {
+				return 0, fmt.Errorf("cycle at node: %q", node)
+			}
+			seen[node] = true
+			parent, exists := nodeHierarchy[node]
+			if !exists || parent == "" {
+				break
+			}
+			node = parent
+			d++
+		}
+		return d, nil
+	}
+
+	for node := range nodeHierarchy {
+		if _, err := depth(node); err != nil {
+			return err
+		}
+	}
+
+	firstNode, firstDepth := "", 0
+	for i, node := range nodes {
+		if child, exists := children[node]; exists {
+			return fmt.Errorf("node: %q, is both a leaf and the"+
+				" parent of: %q", node, child)
+		}
+		d, _ := depth(node)
+		if i == 0 {
+			firstNode, firstDepth = node, d
+		} else if d != firstDepth {
+			return fmt.Errorf("inconsistent depth, node: %q, depth: %d,"+
+				" node: %q, depth: %d", firstNode, firstDepth, node, d)
+		}
+	}
+
+	return nil
+}
+
+// Adds the path of ancestors (from the top down) to the
+// nodeHierarchy, where the roots tracks the names that were the top of
+// a path, returning an error on an empty name, on a name that already
+// has a different parent, or on a name that is a root in one path but
+// has a parent in another.
+func addHierarchyPath(nodeHierarchy map[string]string,
+	roots map[string]bool, parts []string) error {
+	for i, part := range parts {
+		if part == "" {
+			return fmt.Errorf("empty name at level: %d", i)
+		}
+		parent, exists := nodeHierarchy[part]
+		if i == 0 {
+			if exists {
+				return fmt.Errorf("name: %q, is a root but has parent: %q",
+					part, parent)
+			}
+			roots[part] = true
+			continue
+		}
+		if roots[part] {
+			return fmt.Errorf("name: %q, is a root but has parent: %q",
+				part, parts[i-1])
+		}
+		if exists && parent != parts[i-1] {
+			return fmt.Errorf("name: %q, has parents: %q and %q",
+				part, parent, parts[i-1])
+		}
+		nodeHierarchy[part] = parts[i-1]
+	}
+	return nil
+}
+
+// Returns an error unless the depth of each node in the
+// nodeHierarchy, which is its number of ancestors, is the expected
+// depth.
+func checkHierarchyDepths(nodeHierarchy map[string]string,
+	nodeDepths map[string]int) error {
+	for node, expDepth := range nodeDepths {
+		if d := len(ancestors(node, nodeHierarchy)); d != expDepth {
+			return fmt.Errorf("node: %q, depth: %d, expected depth: %d",
+				node, d, expDepth)
+		}
+	}
+	return nil
+}
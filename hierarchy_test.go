@@ -0,0 +1,108 @@
+package blance
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNodeHierarchyFromPaths(t *testing.T) {
+	tests := []struct {
+		paths  []string
+		exp    map[string]string
+		expErr bool
+	}{
+		{nil, map[string]string{}, false},
+		{
+			[]string{"dc1/rack1/a", "dc1/rack1/b", "dc1/rack2/c", "dc2/rack3/d"},
+			map[string]string{
+				"a": "rack1", "b": "rack1", "c": "rack2", "d": "rack3",
+				"rack1": "dc1", "rack2": "dc1", "rack3": "dc2",
+			},
+			false,
+		},
+		{[]string{"a", "b"}, map[string]string{}, false},
+		{[]string{"dc1//a"}, nil, true},
+		{[]string{"dc1/rack1/a", "dc2/rack1/b"}, nil, true},
+		{[]string{"dc1/rack1/a", "dc1/b"}, nil, true},
+		{[]string{"dc1/a", "dc1/a/b"}, nil, true},
+		{[]string{"dc1/a", "a/dc1"}, nil, true},
+		{[]string{"dc1/n1", "x/dc1/n2"}, nil, true},
+		{[]string{"x/dc1/n2", "dc1/n1"}, nil, true},
+		{[]string{"a", "x/a"}, nil, true},
+	}
+	for i, c := range tests {
+		r, err := NodeHierarchyFromPaths(c.paths)
+		if (err != nil) != c.expErr {
+			t.Errorf("i: %d, paths: %v, expErr: %v, got: %v",
+				i, c.paths, c.expErr, err)
+		}
+		if !reflect.DeepEqual(r, c.exp) {
+			t.Errorf("i: %d, paths: %v, exp: %v, got: %v",
+				i, c.paths, c.exp, r)
+		}
+	}
+}
+
+func TestNodeHierarchyFromLabels(t *testing.T) {
+	labelKeys := []string{"region", "zone", "rack"}
+	r, err := NodeHierarchyFromLabels(map[string]map[string]string{
+		"a": {"region": "us", "zone": "us-1a", "rack": "r1"},
+		"b": {"region": "us", "zone": "us-1b", "rack": "r2", "ssd": "y"},
+		"c": {"region": "eu", "zone": "eu-1a", "rack": "r3"},
+	}, labelKeys)
+	exp := map[string]string{
+		"a": "r1", "b": "r2", "c": "r3",
+		"r1": "us-1a", "r2": "us-1b", "r3": "eu-1a",
+		"us-1a": "us", "us-1b": "us", "eu-1a": "eu",
+	}
+	if err != nil || !reflect.DeepEqual(r, exp) {
+		t.Errorf("exp: %v, got: %v, err: %v", exp, r, err)
+	}
+
+	_, err = NodeHierarchyFromLabels(map[string]map[string]string{
+		"a": {"region": "us", "zone": "us-1a", "rack": "r1"},
+		"b": {"region": "us", "zone": "us-1a"},
+	}, labelKeys)
+	if err == nil {
+		t.Errorf("expected err on a missing label")
+	}
+
+	_, err = NodeHierarchyFromLabels(map[string]map[string]string{
+		"a": {"region": "us", "zone": "z1", "rack": "r1"},
+		"b": {"region": "eu", "zone": "z1", "rack": "r2"},
+	}, labelKeys)
+	if err == nil {
+		t.Errorf("expected err on a zone in two regions")
+	}
+
+	_, err = NodeHierarchyFromLabels(map[string]map[string]string{
+		"a": {"region": "us", "zone": "z1", "rack": "r1"},
+		"b": {"region": "z1", "zone": "z2", "rack": "r2"},
+	}, labelKeys)
+	if err == nil {
+		t.Errorf("expected err on a zone that is also a region")
+	}
+}
+
+func TestValidateNodeHierarchy(t *testing.T) {
+	tests := []struct {
+		nodeHierarchy map[string]string
+		nodes         []string
+		expErr        bool
+	}{
+		{nil, nil, false},
+		{map[string]string{"a": "r0", "b": "r1", "r0": "z0"}, nil, true},
+		{map[string]string{"a": "r0", "b": "r1", "r0": "z0", "r1": "z0"},
+			nil, false},
+		{map[string]string{"a": "r0", "r0": "z0", "z0": "a"}, nil, true},
+		{map[string]string{"a": "r0", "b": "a"}, []string{"a", "b"}, true},
+		{map[string]string{"a": "r0", "b": "r0"}, []string{"a", "b"}, false},
+		{map[string]string{"a": "r0"}, []string{"a", "c"}, true},
+	}
+	for i, c := range tests {
+		err := ValidateNodeHierarchy(c.nodeHierarchy, c.nodes)
+		if (err != nil) != c.expErr {
+			t.Errorf("i: %d, expErr: %v, got: %v", i, c.expErr, err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A KeyRange is the range of keys of a range-sharded Partition, from
+// the Start key (inclusive) to the End key (exclusive), where keys are
+// compared bytewise.  An empty Start means the beginning of the key
+// space and an empty End means the end of the key space, so the
+// KeyRange{} covers every key.
+type KeyRange struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+// Contains returns true when the key is within the KeyRange.
+func (r *KeyRange) Contains(key string) bool {
+	return key >= r.Start && (r.End == "" || key < r.End)
+}
+
+func (r *KeyRange) String() string {
+	return fmt.Sprintf("[%q, %q)", r.Start, r.End)
+}
+
+// ValidateKeyRanges returns an error unless every partition of the
+// partitionMap has a KeyRange and the KeyRanges are non-empty,
+// non-overlapping and together cover the entire key space.
+func ValidateKeyRanges(partitionMap PartitionMap) error {
+	partitions, err := sortPartitionsByKeyRange(partitionMap)
+	if err != nil {
+		return err
+	}
+	if len(partitions) <= 0 {
+		return fmt.Errorf("no partitions")
+	}
+
+	next := "" // The Start of the next partition.
+	for i, partition := range partitions {
+		r := partition.KeyRange
+		if r.End != "" && r.Start >= r.End {
+			return fmt.Errorf("empty key range: %v, partition: %q",
+				r, partition.Name)
+		}
+		if r.Start != next {
+			if r.Start < next {
+				return fmt.Errorf("overlapping key range: %v,"+
+					" partition: %q", r, partition.Name)
+			}
+			return fmt.Errorf("key range gap before: %v, partition: %q",
+				r, partition.Name)
+		}
+		if r.End == "" && i < len(partitions)-1 {
+			return fmt.Errorf("overlapping key range: %v, partition: %q",
+				partitions[i+1].KeyRange, partitions[i+1].Name)
+		}
+		next = r.End
+	}
+	if next != "" {
+		return fmt.Errorf("key range gap after: %q", next)
+	}
+
+	return nil
+}
+
+// SplitPartitionByKey is like SplitPartition(), but for a partition
+// with a KeyRange, which is split at the splitKeys.  The splitKeys
+// must be in increasing order and strictly inside the partition's
+// KeyRange, and there must be one more of the newPartitionNames than
+// of the splitKeys.  The new partitions take their KeyRanges in the
+// order of the newPartitionNames.
+func SplitPartitionByKey(partitionMap PartitionMap, partitionName string,
+	splitKeys []string, newPartitionNames []string) (PartitionMap, error) {
+	partition, exists := partitionMap[partitionName]
+	if !exists {
+		return nil, fmt.Errorf("unknown partition: %q", partitionName)
+	}
+	r := partition.KeyRange
+	if r == nil {
+		return nil, fmt.Errorf("no key range for partition: %q",
+			partitionName)
+	}
+	if len(newPartitionNames) != len(splitKeys)+1 {
+		return nil, fmt.Errorf("need %d new partitions for %d split keys,"+
+			" partition: %q", len(splitKeys)+1, len(splitKeys), partitionName)
+	}
+
+	prev := r.Start
+	for _, splitKey := range splitKeys {
+		if splitKey <= prev || (r.End != "" && splitKey >= r.End) {
+			return nil, fmt.Errorf("split key: %q out of order or outside"+
+				" of key range: %v, partition: %q", splitKey, r, partitionName)
+		}
+		prev = splitKey
+	}
+
+	rv, err := SplitPartition(partitionMap, partitionName, newPartitionNames)
+	if err != nil {
+		return nil, err
+	}
+
+	start := r.Start
+	for i, newPartitionName := range newPartitionNames {
+		end := r.End
+		if i < len(splitKeys) {
+			end = splitKeys[i]
+		}
+		rv[newPartitionName].KeyRange = &KeyRange{Start: start, End: end}
+		start = end
+	}
+
+	return rv, nil
+}
+
+// MergePartitionsByKey is like MergePartitions(), but for partitions
+// with KeyRanges, which must be adjacent so that the merged partition
+// has a single KeyRange that covers exactly the merged KeyRanges.
+func MergePartitionsByKey(partitionMap PartitionMap, partitionNames []string,
+	newPartitionName string, partitionWeights map[string]int) (
+	PartitionMap, error) {
+	toMerge := make(PartitionMap, len(partitionNames))
+	for _, partitionName := range partitionNames {
+		partition, exists := partitionMap[partitionName]
+		if !exists {
+			return nil, fmt.Errorf("unknown partition: %q", partitionName)
+		}
+		toMerge[partitionName] = partition
+	}
+
+	partitions, err := sortPartitionsByKeyRange(toMerge)
+	if err != nil {
+		return nil, err
+	}
+	if len(partitions) <= 0 {
+		return nil, fmt.Errorf("no partitions to merge into: %q",
+			newPartitionName)
+	}
+	for i := 1; i < len(partitions); i++ {
+		if partitions[i-1].KeyRange.End == "" ||
+			partitions[i-1].KeyRange.End != partitions[i].KeyRange.Start {
+			return nil, fmt.Errorf("key ranges not adjacent: %v, %v,"+
+				" partitions: %q, %q",
+				partitions[i-1].KeyRange, partitions[i].KeyRange,
+				partitions[i-1].Name, partitions[i].Name)
+		}
+	}
+
+	rv, err := MergePartitions(partitionMap, partitionNames,
+		newPartitionName, partitionWeights)
+	if err != nil {
+		return nil, err
+	}
+
+	rv[newPartitionName].KeyRange = &KeyRange{
+		Start: partitions[0].KeyRange.Start,
+		End:   partitions[len(partitions)-1].KeyRange.End,
+	}
+
+	return rv, nil
+}
+
+// Returns the partitions sorted by the Start of their KeyRange, or an
+// error if some partition has no KeyRange.
+func sortPartitionsByKeyRange(partitionMap PartitionMap) (
+	[]*Partition, error) {
+	rv := make([]*Partition, 0, len(partitionMap))
+	for partitionName, partition := range partitionMap {
+		if partition.KeyRange == nil {
+			return nil, fmt.Errorf("no key range for partition: %q",
+				partitionName)
+		}
+		rv = append(rv, partition)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].KeyRange.Start != rv[j].KeyRange.Start {
+			return rv[i].KeyRange.Start < rv[j].KeyRange.Start
+		}
+		return rv[i].Name < rv[j].Name
+	})
+	return rv, nil
+}
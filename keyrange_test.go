@@ -0,0 +1,181 @@
+package blance
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeyRangeContains(t *testing.T) {
+	tests := []struct {
+		r   KeyRange
+		key string
+		exp bool
+	}{
+		{KeyRange{}, "", true},
+		{KeyRange{}, "zzz", true},
+		{KeyRange{"", "m"}, "a", true},
+		{KeyRange{"", "m"}, "m", false},
+		{KeyRange{"m", ""}, "m", true},
+		{KeyRange{"m", ""}, "lzz", false},
+		{KeyRange{"b", "d"}, "c", true},
+		{KeyRange{"b", "d"}, "d", false},
+	}
+	for i, c := range tests {
+		if got := c.r.Contains(c.key); got != c.exp {
+			t.Errorf("i: %d, r: %v, key: %q, exp: %v, got: %v",
+				i, &c.r, c.key, c.exp, got)
+		}
+	}
+}
+
+func TestValidateKeyRanges(t *testing.T) {
+	ranges := func(rs ...*KeyRange) PartitionMap {
+		rv := PartitionMap{}
+		for i, r := range rs {
+			name := string(rune('0' + i))
+			rv[name] = &Partition{Name: name, KeyRange: r}
+		}
+		return rv
+	}
+	tests := []struct {
+		partitionMap PartitionMap
+		expErr       bool
+	}{
+		{ranges(&KeyRange{}), false},
+		{ranges(&KeyRange{"", "m"}, &KeyRange{"m", ""}), false},
+		{ranges(&KeyRange{"t", ""}, &KeyRange{"", "g"},
+			&KeyRange{"g", "t"}), false},
+		{PartitionMap{}, true},
+		{ranges(&KeyRange{}, nil), true},
+		{ranges(&KeyRange{"", "m"}), true},
+		{ranges(&KeyRange{"a", ""}), true},
+		{ranges(&KeyRange{"", "m"}, &KeyRange{"n", ""}), true},
+		{ranges(&KeyRange{"", "n"}, &KeyRange{"m", ""}), true},
+		{ranges(&KeyRange{}, &KeyRange{"m", ""}), true},
+		{ranges(&KeyRange{"", "m"}, &KeyRange{"m", "m"},
+			&KeyRange{"m", ""}), true},
+	}
+	for i, c := range tests {
+		err := ValidateKeyRanges(c.partitionMap)
+		if (err != nil) != c.expErr {
+			t.Errorf("i: %d, expErr: %v, got: %v", i, c.expErr, err)
+		}
+	}
+}
+
+func TestSplitMergePartitionsByKey(t *testing.T) {
+	m := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{
+			"primary": {"a"}, "replica": {"b"},
+		}, KeyRange: &KeyRange{"", "m"}},
+		"1": &Partition{Name: "1", NodesByState: map[string][]string{
+			"primary": {"b"}, "replica": {"c"},
+		}, KeyRange: &KeyRange{"m", ""}},
+	}
+
+	r, err := SplitPartitionByKey(m, "1", []string{"p", "t"},
+		[]string{"1a", "1b", "1c"})
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	exp := map[string]*KeyRange{
+		"0":  {"", "m"},
+		"1a": {"m", "p"},
+		"1b": {"p", "t"},
+		"1c": {"t", ""},
+	}
+	for partitionName, expRange := range exp {
+		if !reflect.DeepEqual(r[partitionName].KeyRange, expRange) {
+			t.Errorf("partition: %s, exp: %v, got: %v",
+				partitionName, expRange, r[partitionName].KeyRange)
+		}
+	}
+	if len(r) != len(exp) || ValidateKeyRanges(r) != nil {
+		t.Errorf("expected valid split map, got: %v", r)
+	}
+	if !reflect.DeepEqual(r["1b"].NodesByState, m["1"].NodesByState) {
+		t.Errorf("expected split partition to keep its nodes")
+	}
+
+	r, err = MergePartitionsByKey(r, []string{"1b", "0", "1a"}, "01",
+		nil)
+	if err != nil {
+		t.Errorf("expected no err, got: %v", err)
+	}
+	if len(r) != 2 ||
+		!reflect.DeepEqual(r["01"].KeyRange, &KeyRange{"", "t"}) ||
+		ValidateKeyRanges(r) != nil {
+		t.Errorf("expected valid merged map, got: %v", r)
+	}
+
+	if !reflect.DeepEqual(m["1"].KeyRange, &KeyRange{"m", ""}) {
+		t.Errorf("expected m to be unchanged")
+	}
+
+	errTests := []struct {
+		partitionName     string
+		splitKeys         []string
+		newPartitionNames []string
+	}{
+		{"x", []string{"p"}, []string{"1a", "1b"}},
+		{"1", []string{"p"}, []string{"1a"}},
+		{"1", []string{"m"}, []string{"1a", "1b"}},
+		{"0", []string{"m"}, []string{"0a", "0b"}},
+		{"1", []string{"t", "p"}, []string{"1a", "1b", "1c"}},
+		{"1", []string{"p"}, []string{"1a", "0"}},
+	}
+	for i, c := range errTests {
+		_, err := SplitPartitionByKey(m, c.partitionName, c.splitKeys,
+			c.newPartitionNames)
+		if err == nil {
+			t.Errorf("i: %d, expected split err", i)
+		}
+	}
+
+	r, _ = SplitPartitionByKey(m, "1", []string{"p", "t"},
+		[]string{"1a", "1b", "1c"})
+	for i, partitionNames := range [][]string{
+		nil,
+		{"0", "x"},
+		{"0", "1b"},
+		{"1c", "0"},
+	} {
+		_, err := MergePartitionsByKey(r, partitionNames, "n", nil)
+		if err == nil {
+			t.Errorf("i: %d, expected merge err", i)
+		}
+	}
+
+	_, err = MergePartitionsByKey(PartitionMap{
+		"0": &Partition{Name: "0"},
+		"1": &Partition{Name: "1", KeyRange: &KeyRange{}},
+	}, []string{"0", "1"}, "01", nil)
+	if err == nil {
+		t.Errorf("expected merge err without key range")
+	}
+}
+
+func TestPlanNextMapKeepsKeyRanges(t *testing.T) {
+	m := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{},
+			KeyRange: &KeyRange{"", "m"}},
+		"1": &Partition{Name: "1", NodesByState: map[string][]string{},
+			KeyRange: &KeyRange{"m", ""}},
+	}
+	model := PartitionModel{
+		"primary": &PartitionModelState{Priority: 0, Constraints: 1},
+	}
+	r, _ := PlanNextMapEx(m, []string{"a", "b"}, nil, nil, model,
+		PlanNextMapOptions{})
+	for partitionName, partition := range m {
+		if !reflect.DeepEqual(r[partitionName].KeyRange,
+			partition.KeyRange) {
+			t.Errorf("partition: %s, exp: %v, got: %v", partitionName,
+				partition.KeyRange, r[partitionName].KeyRange)
+		}
+	}
+	r, _ = PlanFailover(r, []string{"a"}, model, PlanNextMapOptions{})
+	if ValidateKeyRanges(r) != nil {
+		t.Errorf("expected failover to keep key ranges, got: %v", r)
+	}
+}
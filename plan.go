@@ -23,6 +23,17 @@ import (
 // only needs only 1 or 2 iterations.
 var MaxIterationsPerPlan = 10
 
+// SoftTaintPenalty is the score penalty, roughly in units of
+// partitions, that a node receives for each PreferNoSchedule taint
+// that a partition doesn't tolerate.  A larger penalty means such
+// nodes are used only when other nodes are much more loaded.
+var SoftTaintPenalty = 10.0
+
+// DefaultPreferredBonus is the score bonus, roughly in units of
+// partitions, that a preferred node of a state receives, when the
+// PlanNextMapOptions.PreferredBonus is not specified.
+var DefaultPreferredBonus = 1.5
+
 func planNextMapEx(
 	prevMap PartitionMap,
 	nodesAll, // Union of nodesBefore, nodesToAdd, nodesToRemove.
@@ -30,10 +41,37 @@ func planNextMapEx(
 	nodesToAdd []string,
 	model PartitionModel,
 	opts PlanNextMapOptions,
-) (nextMap PartitionMap, warnings []string) {
+) (nextMap PartitionMap, warnings []*Warning) {
+	replacements, replacementWarnings :=
+		calcNodeReplacements(nodesToRemove, nodesToAdd, opts)
+	if len(replacements) > 0 {
+		// Swap each replaced node for its replacement, so that only
+		// the nodes without a replacement are left to be planned.
+		prevMap = replaceNodesInMap(prevMap, replacements)
+		for oldNode, newNode := range replacements {
+			nodesAll = StringsRemoveStrings(nodesAll, []string{oldNode})
+			nodesToRemove =
+				StringsRemoveStrings(nodesToRemove, []string{oldNode})
+			nodesToAdd = StringsRemoveStrings(nodesToAdd, []string{newNode})
+		}
+		if len(nodesToRemove) <= 0 && len(nodesToAdd) <= 0 {
+			return prevMap, append([]*Warning{}, replacementWarnings...)
+		}
+	}
+
+	begMap, begNodesAll, begNodesToRemove := prevMap, nodesAll, nodesToRemove
+
+	// Keyed by partitionName, the partitions that any iteration
+	// reassigned to meet a placement rule.
+	fixedPartitions := map[string]bool{}
+
 	for i := 0; i < MaxIterationsPerPlan; i++ { // Loop for convergence.
-		nextMap, warnings = planNextMapInnerEx(prevMap,
+		var fixed map[string]bool
+		nextMap, warnings, fixed = planNextMapInnerEx(prevMap,
 			nodesAll, nodesToRemove, nodesToAdd, model, opts)
+		for partitionName := range fixed {
+			fixedPartitions[partitionName] = true
+		}
 		if reflect.DeepEqual(nextMap, prevMap) {
 			break
 		}
@@ -42,6 +80,44 @@ func planNextMapEx(
 		nodesToRemove = []string{}
 		nodesToAdd = []string{}
 	}
+	if opts.BalanceTolerance > 0 {
+		var keptPartitions map[string]bool
+		nextMap, keptPartitions = applyBalanceTolerance(begMap, nextMap,
+			begNodesAll, begNodesToRemove, fixedPartitions, model, opts)
+
+		// The warnings of a partition that kept its begMap assignments
+		// were about the planned assignments, so they are recomputed
+		// by planning just the kept partitions from the nextMap.
+		if len(keptPartitions) > 0 {
+			keptOpts := opts
+			keptOpts.ScopePartitions = make([]string, 0, len(keptPartitions))
+			for partitionName := range keptPartitions {
+				keptOpts.ScopePartitions =
+					append(keptOpts.ScopePartitions, partitionName)
+			}
+			sort.Strings(keptOpts.ScopePartitions)
+
+			_, keptWarnings, _ := planNextMapInnerEx(nextMap,
+				StringsRemoveStrings(begNodesAll, begNodesToRemove),
+				[]string{}, []string{}, model, keptOpts)
+
+			rv := make([]*Warning, 0, len(warnings))
+			for _, w := range warnings {
+				if !keptPartitions[w.PartitionName] {
+					rv = append(rv, w)
+				}
+			}
+			for _, w := range keptWarnings {
+				if keptPartitions[w.PartitionName] {
+					rv = append(rv, w)
+				}
+			}
+			warnings = rv
+		}
+	}
+	if len(replacementWarnings) > 0 {
+		warnings = append(replacementWarnings, warnings...)
+	}
 	return nextMap, warnings
 }
 
@@ -52,8 +128,13 @@ func planNextMapInnerEx(
 	nodesToAdd []string,
 	model PartitionModel,
 	opts PlanNextMapOptions,
-) (PartitionMap, []string) {
-	warnings := []string{}
+) (PartitionMap, []*Warning, map[string]bool) {
+	warnings := []*Warning{}
+
+	// Keyed by partitionName, the partitions whose previous assignments
+	// broke a placement rule that the planner enforces, rather than
+	// merely prefers, and which were reassigned to meet the rule.
+	fixedPartitions := map[string]bool{}
 
 	nodePositions := map[string]int{}
 	for i, node := range nodesAll {
@@ -64,27 +145,58 @@ func planNextMapInnerEx(
 
 	hierarchyChildren := mapParentsToMapChildren(opts.NodeHierarchy)
 
+	scopePartitions := StringsToMap(opts.ScopePartitions)
+
+	// Returns true if the partition's assignments may be changed.
+	partitionInScope := func(partitionName string) bool {
+		return opts.ScopePartitions == nil || scopePartitions[partitionName]
+	}
+
+	// Returns the nodes whose assignments may not be changed.
+	outOfScopeNodes := func(nodes []string) []string {
+		if opts.ScopeNodes == nil {
+			return nil
+		}
+		return StringsRemoveStrings(nodes, opts.ScopeNodes)
+	}
+
 	// Start by filling out nextPartitions as a deep clone of
 	// prevMap.Partitions, but filter out the to-be-removed nodes.
 	nextPartitions := prevMap.toArrayCopy()
 	for _, partition := range nextPartitions {
-		partition.NodesByState =
-			removeNodesFromNodesByState(partition.NodesByState,
-				nodesToRemove, nil)
+		if partitionInScope(partition.Name) {
+			partition.NodesByState =
+				removeNodesFromNodesByState(partition.NodesByState,
+					StringsRemoveStrings(nodesToRemove,
+						outOfScopeNodes(nodesToRemove)), nil)
+		}
 	}
 	sort.Sort(&partitionSorter{a: nextPartitions})
 
 	// Key is stateName, value is {node: count}.
 	stateNodeCounts := countStateNodes(prevMap, opts.PartitionWeights)
 
+	// Key is stateName, value is constraints.
+	stateConstraints := calcStateConstraints(model, opts)
+
+	// Key is stateName, value is the set of preferred nodes.
+	statePreferredNodes := calcStatePreferredNodes(opts, hierarchyChildren)
+
+	preferredBonus := opts.PreferredBonus
+	if preferredBonus <= 0 {
+		preferredBonus = DefaultPreferredBonus
+	}
+
 	// Helper function that returns an ordered array of candidates
-	// nodes to assign to a partition, ordered by best heuristic fit.
+	// nodes to assign to a partition, ordered by best heuristic fit,
+	// and whether the partition's current nodes for the state break a
+	// placement rule that the returned nodes meet.
 	findBestNodes := func(
 		partition *Partition,
 		stateName string,
 		constraints int,
 		nodeToNodeCounts map[string]map[string]int,
-	) []string {
+	) ([]string, bool) {
 		stickiness := 1.5
 		if opts.PartitionWeights != nil {
 			w, exists := opts.PartitionWeights[partition.Name]
@@ -98,13 +210,10 @@ func planNextMapInnerEx(
 			}
 		}
 
-		// Keyed by node, value is sum of partitions on that node.
-		nodePartitionCounts := make(map[string]int)
-		for _, nodeCounts := range stateNodeCounts {
-			for node, nodeCount := range nodeCounts {
-				nodePartitionCounts[node] += nodeCount
-			}
-		}
+		// Keyed by node, value is sum of partitions on that node,
+		// scaled by the optional per-state load factors.
+		nodePartitionCounts :=
+			countNodeLoads(stateNodeCounts, opts.StateLoadFactor)
 
 		topPriorityStateName := ""
 		for stateName, state := range model {
@@ -122,6 +231,12 @@ func planNextMapInnerEx(
 
 		statePriority := model[stateName].Priority
 
+		// The current nodes of the state that may be reassigned, which
+		// are checked against the same rules as the candidates.
+		curNodes := partition.NodesByState[stateName]
+		curNodes = StringsRemoveStrings(curNodes, outOfScopeNodes(curNodes))
+		breaksRules := false
+
 		candidateNodes := append([]string(nil), nodesNext...)
 
 		// Filter out nodes of a higher priority state; e.g., if we're
@@ -138,6 +253,135 @@ func planNextMapInnerEx(
 
 		candidateNodes = excludeHigherPriorityNodes(candidateNodes)
 
+		// Filter out nodes that have an explicit weight of 0 for this
+		// state, as they should not receive new assignments.  Unless
+		// draining is requested, a zero weight node keeps what it
+		// already holds.
+		excludeZeroWeightNodes := func(remainingNodes []string) []string {
+			rv := make([]string, 0, len(remainingNodes))
+			for _, node := range remainingNodes {
+				w, exists := stateNodeWeight(opts.StateNodeWeights,
+					opts.NodeWeights, stateName, node)
+				if exists && w == 0 && (opts.DrainZeroWeightNodes ||
+					!nodeHasState(partition, stateName, node)) {
+					continue
+				}
+				rv = append(rv, node)
+			}
+			return rv
+		}
+
+		// Filter out nodes whose labels don't match the node selectors
+		// of the state or of the partition.
+		excludeUnselectedNodes := func(remainingNodes []string) []string {
+			if len(opts.StateNodeSelectors[stateName]) == 0 &&
+				len(opts.PartitionNodeSelectors[partition.Name]) == 0 {
+				return remainingNodes
+			}
+			rv := make([]string, 0, len(remainingNodes))
+			for _, node := range remainingNodes {
+				if nodeSelected(opts, partition.Name, stateName, node) {
+					rv = append(rv, node)
+				}
+			}
+			return rv
+		}
+
+		// Filter out nodes that have NoSchedule taints that the
+		// partition doesn't tolerate.
+		excludeTaintedNodes := func(remainingNodes []string) []string {
+			if opts.NodeTaints == nil {
+				return remainingNodes
+			}
+			rv := make([]string, 0, len(remainingNodes))
+			for _, node := range remainingNodes {
+				if !nodeTainted(opts, partition.Name, node) {
+					rv = append(rv, node)
+				}
+			}
+			return rv
+		}
+
+		// Filter out nodes that are not in the ScopeNodes.
+		excludeOutOfScopeNodes := func(remainingNodes []string) []string {
+			if opts.ScopeNodes == nil {
+				return remainingNodes
+			}
+			return StringsIntersectStrings(remainingNodes, opts.ScopeNodes)
+		}
+
+		// Keyed by node, value is the score penalty from any
+		// PreferNoSchedule taints that the partition doesn't tolerate,
+		// less the bonus for a preferred node of the state.
+		var nodePenalties map[string]float64
+		if opts.NodeTaints != nil || statePreferredNodes[stateName] != nil {
+			nodePenalties = make(map[string]float64)
+			tolerations := opts.PartitionTolerations[partition.Name]
+			for node, taints := range opts.NodeTaints {
+				n := countUntoleratedTaints(taints, tolerations,
+					TaintPreferNoSchedule)
+				if n > 0 {
+					nodePenalties[node] = SoftTaintPenalty * float64(n)
+				}
+			}
+			for node := range statePreferredNodes[stateName] {
+				nodePenalties[node] -= preferredBonus
+			}
+		}
+
+		// Keyed by node, value is the load per capacity of the node's
+		// failure domains at the optional balance levels.
+		var nodeDomainLoads map[string]float64
+		if len(opts.BalanceLevels) > 0 {
+			nodeDomainLoads = calcNodeDomainLoads(nodesNext,
+				opts.BalanceLevels, stateNodeCounts[stateName],
+				func(node string) float64 {
+					w, exists := stateNodeWeight(opts.StateNodeWeights,
+						opts.NodeWeights, stateName, node)
+					if exists {
+						return float64(w)
+					}
+					return 1.0
+				}, opts.NodeHierarchy)
+		}
+
+		// The candidate filters are applied in order, where the
+		// warningKind and cause are used to report the first filter
+		// that made the constraints unsatisfiable.  The isRule filters
+		// are placement rules, which the current nodes must also pass.
+		candidateFilters := []struct {
+			warningKind string
+			cause       string
+			isRule      bool
+			exclude     func(remainingNodes []string) []string
+		}{
+			{WarningZeroNodeWeights, "zero node weights", true, excludeZeroWeightNodes},
+			{WarningNodeSelectors, "node selectors", true, excludeUnselectedNodes},
+			{WarningNodeTaints, "node taints", true, excludeTaintedNodes},
+			{WarningScope, "node scope", false, excludeOutOfScopeNodes},
+		}
+
+		filterCandidateNodes := func(remainingNodes []string) []string {
+			for _, f := range candidateFilters {
+				remainingNodes = f.exclude(remainingNodes)
+			}
+			return remainingNodes
+		}
+
+		warningKind, warningCause := WarningConstraints, ""
+		for _, f := range candidateFilters {
+			numCandidateNodes := len(candidateNodes)
+			candidateNodes = f.exclude(candidateNodes)
+			if numCandidateNodes >= constraints &&
+				len(candidateNodes) < constraints &&
+				warningCause == "" {
+				warningKind, warningCause = f.warningKind, f.cause
+			}
+			if f.isRule && len(f.exclude(curNodes)) < len(curNodes) {
+				breaksRules = true
+			}
+		}
+
 		sort.Sort(&nodeSorter{
 			stateName:           stateName,
 			partition:           partition,
@@ -148,27 +392,61 @@ func planNextMapInnerEx(
 			nodePartitionCounts: nodePartitionCounts,
 			nodePositions:       nodePositions,
 			nodeWeights:         opts.NodeWeights,
+			stateNodeWeights:    opts.StateNodeWeights,
+			nodePenalties:       nodePenalties,
+			nodeDomainLoads:     nodeDomainLoads,
 			stickiness:          stickiness,
 			a:                   candidateNodes,
 		})
 
+		// Number of slots left unfilled due to required hierarchy
+		// rules that had no candidate nodes.
+		numUnfilled := 0
+
 		if opts.HierarchyRules != nil {
 			hierarchyNodes := []string{}
 
 			for _, hierarchyRule := range opts.HierarchyRules[stateName] {
+				if len(hierarchyNodes)+numUnfilled >= constraints {
+					break // The rules already account for every slot.
+				}
+
 				h := topPriorityNode
 				if h == "" && len(hierarchyNodes) > 0 {
 					h = hierarchyNodes[0]
 				}
 
-				hierarchyCandidates := includeExcludeNodes(h,
-					hierarchyRule.IncludeLevel,
-					hierarchyRule.ExcludeLevel,
-					opts.NodeHierarchy, hierarchyChildren)
+				var hierarchyCandidates []string
+				if hierarchyRule.AnchorState == "" {
+					hierarchyCandidates = includeExcludeNodes(h,
+						hierarchyRule.IncludeLevel,
+						hierarchyRule.ExcludeLevel,
+						opts.NodeHierarchy, hierarchyChildren)
+				} else {
+					// The anchors are every copy of the anchor state,
+					// where nodes that were chosen by earlier rules
+					// are the copies of the state being assigned.
+					anchorNodes := hierarchyNodes
+					if hierarchyRule.AnchorState != stateName {
+						anchorNodes =
+							partition.NodesByState[hierarchyRule.AnchorState]
+					}
+					if len(anchorNodes) > 0 {
+						hierarchyCandidates = includeExcludeAnchorNodes(
+							anchorNodes,
+							hierarchyRule.IncludeLevel,
+							hierarchyRule.ExcludeLevel,
+							opts.NodeHierarchy, hierarchyChildren)
+					} else {
+						hierarchyCandidates = nodesNext
+					}
+				}
 				hierarchyCandidates =
 					StringsIntersectStrings(hierarchyCandidates, nodesNext)
 				hierarchyCandidates =
 					excludeHigherPriorityNodes(hierarchyCandidates)
+				hierarchyCandidates =
+					filterCandidateNodes(hierarchyCandidates)
 
 				sort.Sort(&nodeSorter{
 					stateName:           stateName,
@@ -180,6 +458,9 @@ func planNextMapInnerEx(
 					nodePartitionCounts: nodePartitionCounts,
 					nodePositions:       nodePositions,
 					nodeWeights:         opts.NodeWeights,
+					stateNodeWeights:    opts.StateNodeWeights,
+					nodePenalties:       nodePenalties,
+					nodeDomainLoads:     nodeDomainLoads,
 					stickiness:          stickiness,
 					a:                   hierarchyCandidates,
 				})
@@ -187,22 +468,150 @@ func planNextMapInnerEx(
 				if len(hierarchyCandidates) > 0 {
 					hierarchyNodes = append(hierarchyNodes,
 						hierarchyCandidates[0])
+					if hierarchyRule.Required && len(StringsIntersectStrings(
+						curNodes, hierarchyCandidates)) <= 0 {
+						breaksRules = true
+					}
+				} else if hierarchyRule.Required {
+					numUnfilled++
+					warnings = append(warnings, &Warning{
+						Kind:          WarningHierarchyRequired,
+						PartitionName: partition.Name,
+						StateName:     stateName,
+						Message: fmt.Sprintf("could not meet required"+
+							" hierarchy rule: %+v, stateName: %s,"+
+							" partitionName: %s",
+							*hierarchyRule, stateName, partition.Name),
+					})
 				} else if len(candidateNodes) > 0 {
 					hierarchyNodes = append(hierarchyNodes,
 						candidateNodes[0])
+					warnings = append(warnings, &Warning{
+						Kind:          WarningHierarchyPreferred,
+						PartitionName: partition.Name,
+						StateName:     stateName,
+						Message: fmt.Sprintf("could not meet preferred"+
+							" hierarchy rule: %+v, stateName: %s,"+
+							" partitionName: %s, using node: %s",
+							*hierarchyRule, stateName, partition.Name,
+							candidateNodes[0]),
+					})
 				}
 			}
 
 			candidateNodes = append(hierarchyNodes, candidateNodes...)
 		}
 
-		if len(candidateNodes) >= constraints {
-			candidateNodes = candidateNodes[0:constraints]
+		// The copies of the partition in the other states that were
+		// already assigned, along with how many copies are yet to be
+		// assigned in lower priority states.
+		existingNodes := []string{}
+		remainingCopies := 0
+		for otherStateName, otherState := range model {
+			if otherStateName == stateName || otherState == nil {
+				continue
+			}
+			if otherState.Priority > statePriority {
+				remainingCopies += stateConstraints[otherStateName]
+			} else {
+				existingNodes = append(existingNodes,
+					partition.NodesByState[otherStateName]...)
+			}
+		}
+
+		if len(opts.Copysets) > 0 {
+			var copysetOk bool
+			candidateNodes, copysetOk = selectCopysetNodes(candidateNodes,
+				existingNodes, constraints, opts.Copysets)
+			if !copysetOk {
+				warnings = append(warnings, &Warning{
+					Kind:          WarningCopysets,
+					PartitionName: partition.Name,
+					StateName:     stateName,
+					Message: fmt.Sprintf("could not fit copies into a"+
+						" copyset, stateName: %s, partitionName: %s",
+						stateName, partition.Name),
+				})
+			} else if curCopysetNodes, curOk := selectCopysetNodes(curNodes,
+				existingNodes, constraints, opts.Copysets); !curOk ||
+				len(curCopysetNodes) < len(curNodes) {
+				breaksRules = true
+			}
+		}
+
+		if opts.DomainStateQuotas != nil {
+			quotas := make(map[string]int) // Keyed by domain.
+			for domain, stateQuotas := range opts.DomainStateQuotas {
+				if quota, exists := stateQuotas[stateName]; exists {
+					quotas[domain] = quota
+				}
+			}
+			if len(quotas) > 0 {
+				var shortDomains []string
+				candidateNodes, shortDomains = selectQuotaNodes(
+					candidateNodes, constraints, quotas, opts.NodeHierarchy)
+				curQuotaNodes, curShortDomains := selectQuotaNodes(
+					curNodes, constraints, quotas, opts.NodeHierarchy)
+				if len(curQuotaNodes) < len(curNodes) ||
+					len(curShortDomains) > len(shortDomains) {
+					breaksRules = true
+				}
+				for _, domain := range shortDomains {
+					warnings = append(warnings, &Warning{
+						Kind:          WarningDomainQuotas,
+						PartitionName: partition.Name,
+						StateName:     stateName,
+						Message: fmt.Sprintf("could not meet domain"+
+							" quota: %d, domain: %s, stateName: %s,"+
+							" partitionName: %s", quotas[domain], domain,
+							stateName, partition.Name),
+					})
+				}
+			}
+		}
+
+		if len(opts.SpreadRules) > 0 {
+			var spreadOk bool
+			candidateNodes, spreadOk = selectSpreadNodes(candidateNodes,
+				existingNodes, constraints, remainingCopies,
+				opts.SpreadRules, opts.NodeHierarchy)
+			if !spreadOk {
+				warnings = append(warnings, &Warning{
+					Kind:          WarningSpreadRules,
+					PartitionName: partition.Name,
+					StateName:     stateName,
+					Message: fmt.Sprintf("could not meet spread rules,"+
+						" stateName: %s, partitionName: %s",
+						stateName, partition.Name),
+				})
+			} else if curSpreadNodes, curOk := selectSpreadNodes(curNodes,
+				existingNodes, constraints, remainingCopies,
+				opts.SpreadRules, opts.NodeHierarchy); !curOk ||
+				len(curSpreadNodes) < len(curNodes) {
+				breaksRules = true
+			}
+		}
+
+		numSlots := constraints - numUnfilled
+		if numSlots < 0 {
+			numSlots = 0
+		}
+
+		if len(candidateNodes) >= numSlots {
+			candidateNodes = candidateNodes[0:numSlots]
 		} else {
-			warnings = append(warnings,
-				fmt.Sprintf("could not meet constraints: %d,"+
+			msg := "could not meet constraints"
+			if warningCause != "" {
+				msg += " due to " + warningCause
+			}
+			warnings = append(warnings, &Warning{
+				Kind:          warningKind,
+				PartitionName: partition.Name,
+				StateName:     stateName,
+				Message: fmt.Sprintf("%s: %d,"+
 					" stateName: %s, partitionName: %s",
-					constraints, stateName, partition.Name))
+					msg, constraints, stateName, partition.Name),
+			})
 		}
 
 		// Keep nodeToNodeCounts updated.
@@ -215,7 +624,7 @@ func planNextMapInnerEx(
 			m[candidateNode]++
 		}
 
-		return candidateNodes
+		return candidateNodes, breaksRules
 	}
 
 	// Helper function that given a PartitionModel state name and its
@@ -237,6 +646,10 @@ func planNextMapInnerEx(
 		nodeToNodeCounts := make(map[string]map[string]int)
 
 		for _, partition := range p.a {
+			if !partitionInScope(partition.Name) {
+				continue // Frozen, but still counted in stateNodeCounts.
+			}
+
 			partitionWeight := 1
 			if opts.PartitionWeights != nil {
 				w, exists := opts.PartitionWeights[partition.Name]
@@ -254,9 +667,24 @@ func planNextMapInnerEx(
 					-partitionWeight)
 			}
 
-			nodesToAssign :=
+			// The out of scope nodes keep their assignments, so only
+			// the remaining constraints are assigned.
+			frozenNodes :=
+				outOfScopeNodes(partition.NodesByState[stateName])
+			remainingConstraints := constraints - len(frozenNodes)
+			if remainingConstraints < 0 {
+				remainingConstraints = 0
+			}
+
+			nodesToAssign, breaksRules :=
 				findBestNodes(partition,
-					stateName, constraints, nodeToNodeCounts)
+					stateName, remainingConstraints, nodeToNodeCounts)
+			if breaksRules {
+				fixedPartitions[partition.Name] = true
+			}
+			if len(frozenNodes) > 0 {
+				nodesToAssign = append(frozenNodes, nodesToAssign...)
+			}
 
 			partition.NodesByState =
 				removeNodesFromNodesByState(partition.NodesByState,
@@ -276,21 +704,40 @@ func planNextMapInnerEx(
 	// Run through the sorted partition states (primary, replica, etc)
 	// that have constraints and invoke assignStateToPartitions().
 	for _, stateName := range sortStateNames(model) {
-		constraints := 0
+		constraints := stateConstraints[stateName]
+		if constraints > 0 {
+			assignStateToPartitions(stateName, constraints)
+		}
+	}
 
-		modelState, exists := model[stateName]
-		if exists && modelState != nil {
-			constraints = modelState.Constraints
+	// Report how many partitions could not be placed on the preferred
+	// nodes of a state.
+	for _, stateName := range sortStateNames(model) {
+		preferredNodes := statePreferredNodes[stateName]
+		if preferredNodes == nil || stateConstraints[stateName] <= 0 {
+			continue
 		}
-		if opts.ModelStateConstraints != nil {
-			modelStateConstraints, exists := opts.ModelStateConstraints[stateName]
-			if exists {
-				constraints = modelStateConstraints
+		numMissed := 0
+		for _, partition := range nextPartitions {
+			found := false
+			for _, node := range partition.NodesByState[stateName] {
+				if preferredNodes[node] {
+					found = true
+					break
+				}
+			}
+			if !found {
+				numMissed++
 			}
 		}
-
-		if constraints > 0 {
-			assignStateToPartitions(stateName, constraints)
+		if numMissed > 0 {
+			warnings = append(warnings, &Warning{
+				Kind:      WarningPreferredPlacement,
+				StateName: stateName,
+				Message: fmt.Sprintf("could not place %d of %d"+
+					" partitions on preferred nodes, stateName: %s",
+					numMissed, len(nextPartitions), stateName),
+			})
 		}
 	}
 
@@ -298,7 +745,52 @@ func planNextMapInnerEx(
 	for _, partition := range nextPartitions {
 		rv[partition.Name] = partition
 	}
-	return rv, warnings
+	return rv, warnings, fixedPartitions
+}
+
+// Returns the preferred nodes of each state, keyed by stateName, from
+// the PreferredNodes and the leaves of the PreferredDomains.
+func calcStatePreferredNodes(opts PlanNextMapOptions,
+	mapChildren map[string][]string) map[string]map[string]bool {
+	rv := make(map[string]map[string]bool)
+	add := func(stateName string, nodes []string) {
+		if rv[stateName] == nil {
+			rv[stateName] = make(map[string]bool)
+		}
+		for _, node := range nodes {
+			rv[stateName][node] = true
+		}
+	}
+	for stateName, nodes := range opts.PreferredNodes {
+		add(stateName, nodes)
+	}
+	for stateName, domains := range opts.PreferredDomains {
+		for _, domain := range domains {
+			add(stateName, findLeaves(domain, mapChildren))
+		}
+	}
+	return rv
+}
+
+// Returns the constraints of every model state, keyed by stateName,
+// where the opts.ModelStateConstraints override the model.
+func calcStateConstraints(model PartitionModel,
+	opts PlanNextMapOptions) map[string]int {
+	rv := make(map[string]int)
+	for stateName, modelState := range model {
+		constraints := 0
+		if modelState != nil {
+			constraints = modelState.Constraints
+		}
+		if opts.ModelStateConstraints != nil {
+			modelStateConstraints, exists := opts.ModelStateConstraints[stateName]
+			if exists {
+				constraints = modelStateConstraints
+			}
+		}
+		rv[stateName] = constraints
+	}
+	return rv
 }
 
 // Makes a deep copy of the PartitionMap as an array.
@@ -308,6 +800,7 @@ func (m PartitionMap) toArrayCopy() []*Partition {
 		rv = append(rv, &Partition{
 			Name:         partition.Name,
 			NodesByState: copyNodesByState(partition.NodesByState),
+			KeyRange:     partition.KeyRange,
 		})
 	}
 	return rv
@@ -366,6 +859,31 @@ func countStateNodes(
 	return rv
 }
 
+// Example, with input stateNodeCounts of...
+//   { "primary": { "a": 1, "b": 1 },
+//     "replica": { "b": 1, "c": 2 } }
+// and stateLoadFactor of {"replica": 0.5}, then return value will be...
+//   { "a": 1.0, "b": 1.5, "c": 1.0 }
+func countNodeLoads(
+	stateNodeCounts map[string]map[string]int,
+	stateLoadFactor map[string]float64,
+) map[string]float64 {
+	rv := make(map[string]float64)
+	for stateName, nodeCounts := range stateNodeCounts {
+		loadFactor := 1.0
+		if stateLoadFactor != nil {
+			f, exists := stateLoadFactor[stateName]
+			if exists {
+				loadFactor = f
+			}
+		}
+		for node, nodeCount := range nodeCounts {
+			rv[node] += loadFactor * float64(nodeCount)
+		}
+	}
+	return rv
+}
+
 // --------------------------------------------------------
 
 // Returns a copy of nodesByState but with nodes removed.  Example,
@@ -542,9 +1060,12 @@ type nodeSorter struct {
 	topPriorityNode     string
 	stateNodeCounts     map[string]map[string]int
 	nodeToNodeCounts    map[string]map[string]int
-	nodePartitionCounts map[string]int
+	nodePartitionCounts map[string]float64
 	nodePositions       map[string]int
 	nodeWeights         map[string]int
+	stateNodeWeights    map[string]map[string]int
+	nodePenalties       map[string]float64
+	nodeDomainLoads     map[string]float64
 	stickiness          float64
 
 	a []string // Entries are node names.
@@ -586,7 +1107,7 @@ func (ns *nodeSorter) Score(i int) float64 {
 	if ns.nodePartitionCounts != nil && ns.numPartitions > 0 {
 		c, exists := ns.nodePartitionCounts[node]
 		if exists {
-			filledFactor = (0.001 * float64(c)) / float64(ns.numPartitions)
+			filledFactor = (0.001 * c) / float64(ns.numPartitions)
 		}
 	}
 
@@ -610,11 +1131,18 @@ func (ns *nodeSorter) Score(i int) float64 {
 	r += lowerPriorityBalanceFactor
 	r += filledFactor
 
-	if ns.nodeWeights != nil {
-		w, exists := ns.nodeWeights[node]
-		if exists && w > 0 {
-			r /= float64(w)
-		}
+	w, exists := stateNodeWeight(ns.stateNodeWeights, ns.nodeWeights,
+		ns.stateName, node)
+	if exists && w > 0 {
+		r /= float64(w)
+	}
+
+	if ns.nodeDomainLoads != nil {
+		r += ns.nodeDomainLoads[node]
+	}
+
+	if ns.nodePenalties != nil {
+		r += ns.nodePenalties[node]
 	}
 
 	r -= currentFactor
@@ -622,6 +1150,120 @@ func (ns *nodeSorter) Score(i int) float64 {
 	return r
 }
 
+// Returns true if the labels have every key/value pair of the
+// selector, where a nil or empty selector matches any labels.
+func labelsMatch(labels, selector map[string]string) bool {
+	for k, v := range selector {
+		lv, exists := labels[k]
+		if !exists || lv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if the node's labels match the node selectors of both
+// the state and the partition.
+func nodeSelected(opts PlanNextMapOptions,
+	partitionName, stateName, node string) bool {
+	labels := opts.NodeLabels[node]
+	return labelsMatch(labels, opts.StateNodeSelectors[stateName]) &&
+		labelsMatch(labels, opts.PartitionNodeSelectors[partitionName])
+}
+
+// Returns true if the node has NoSchedule taints that the partition
+// doesn't tolerate.
+func nodeTainted(opts PlanNextMapOptions,
+	partitionName, node string) bool {
+	return countUntoleratedTaints(opts.NodeTaints[node],
+		opts.PartitionTolerations[partitionName], TaintNoSchedule) > 0
+}
+
+// Returns the number of taints with the given effect that are not
+// tolerated by any of the tolerations.
+func countUntoleratedTaints(taints []Taint, tolerations []Toleration,
+	effect string) int {
+	rv := 0
+	for _, taint := range taints {
+		if taint.Effect != effect {
+			continue
+		}
+		tolerated := false
+		for _, toleration := range tolerations {
+			if toleration.Tolerates(taint) {
+				tolerated = true
+				break
+			}
+		}
+		if !tolerated {
+			rv++
+		}
+	}
+	return rv
+}
+
+// Returns true if the partition is assigned to the node in the given
+// state.
+func nodeHasState(partition *Partition, stateName, node string) bool {
+	for _, stateNode := range partition.NodesByState[stateName] {
+		if stateNode == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a map keyed by node, where the value is the sum, across
+// the hierarchy levels, of the load per capacity of the node's
+// failure domain at that level.  The load of a domain is the sum of
+// nodeCounts of its nodes, and the capacity of a domain is the sum of
+// the weights of its nodes.  For example, with levels of [1] and a
+// rack r0 of nodes a & b (each of weight 1) holding 3 partitions, both
+// a and b will have a value of 1.5.
+func calcNodeDomainLoads(nodes []string, levels []int,
+	nodeCounts map[string]int, nodeWeight func(node string) float64,
+	mapParents map[string]string) map[string]float64 {
+	rv := make(map[string]float64)
+	for _, level := range levels {
+		domainCounts := make(map[string]float64)
+		domainWeights := make(map[string]float64)
+		for _, node := range nodes {
+			domain := spreadDomain(node, level, mapParents)
+			domainCounts[domain] += float64(nodeCounts[node])
+			domainWeights[domain] += nodeWeight(node)
+		}
+		for _, node := range nodes {
+			domain := spreadDomain(node, level, mapParents)
+			if domainWeights[domain] > 0 {
+				rv[node] += domainCounts[domain] / domainWeights[domain]
+			}
+		}
+	}
+	return rv
+}
+
+// Returns the weight of a node for a given state, where an entry in
+// stateNodeWeights takes precedence over an entry in nodeWeights.
+func stateNodeWeight(
+	stateNodeWeights map[string]map[string]int,
+	nodeWeights map[string]int,
+	stateName, node string,
+) (int, bool) {
+	if stateNodeWeights != nil {
+		w, exists := stateNodeWeights[stateName][node]
+		if exists {
+			return w, true
+		}
+	}
+	if nodeWeights != nil {
+		w, exists := nodeWeights[node]
+		if exists {
+			return w, true
+		}
+	}
+	return 0, false
+}
+
 // --------------------------------------------------------
 
 // The mapParents is keyed by node, value is parent node.  Returns a
@@ -642,6 +1284,186 @@ func mapParentsToMapChildren(
 	return rv
 }
 
+// Returns up to constraints nodes from the ranked candidateNodes,
+// favoring earlier candidates, so that the chosen nodes along with the
+// existingNodes (copies of the partition in other states) follow the
+// spread rules.  A candidate that would exceed a rule's MaxPerDomain
+// is skipped, and while there are fewer distinct domains than a rule's
+// MinDomains, candidates from new domains are favored.  The remaining
+// param is the number of copies that are still to be assigned after
+// this selection, which is used to decide whether a MinDomains can
+// still be met.  For a QuorumSafe rule, the copies are the
+// existingNodes, the constraints and the remaining copies, where no
+// domain may hold a majority of those copies.  The returned ok is
+// false if a rule could not be met.
+func selectSpreadNodes(candidateNodes, existingNodes []string,
+	constraints, remaining int, rules []*SpreadRule,
+	mapParents map[string]string) (rv []string, ok bool) {
+	ok = true
+
+	totalCopies := len(existingNodes) + constraints + remaining
+
+	// Keyed by rule index, value is the effective MaxPerDomain.
+	maxPerDomains := make([]int, len(rules))
+
+	// Keyed by rule index, then by domain, value is count of copies.
+	domainCounts := make([]map[string]int, len(rules))
+	for i, rule := range rules {
+		maxPerDomains[i] = rule.MaxPerDomain
+		if rule.QuorumSafe {
+			// A majority is totalCopies/2 + 1, so a domain may hold
+			// at most totalCopies/2 copies.  A single copy is always
+			// a majority of itself, so it's placed but not ok.
+			quorumMax := totalCopies / 2
+			if quorumMax < 1 {
+				quorumMax = 1
+				if constraints > 0 {
+					ok = false
+				}
+			}
+			if maxPerDomains[i] <= 0 || maxPerDomains[i] > quorumMax {
+				maxPerDomains[i] = quorumMax
+			}
+		}
+		domainCounts[i] = make(map[string]int)
+		for _, node := range existingNodes {
+			domainCounts[i][spreadDomain(node, rule.Level, mapParents)]++
+		}
+	}
+
+	seen := make(map[string]bool)
+	for len(rv) < constraints {
+		best, bestNewDomains, numUnseen := "", -1, 0
+		for _, node := range candidateNodes {
+			if seen[node] {
+				continue
+			}
+			numUnseen++
+			allowed, newDomains := true, 0
+			for i, rule := range rules {
+				c := domainCounts[i][spreadDomain(node, rule.Level, mapParents)]
+				if maxPerDomains[i] > 0 && c >= maxPerDomains[i] {
+					allowed = false
+					break
+				}
+				if c == 0 && len(domainCounts[i]) < rule.MinDomains {
+					newDomains++
+				}
+			}
+			if allowed && newDomains > bestNewDomains {
+				best, bestNewDomains = node, newDomains
+			}
+		}
+		if best == "" {
+			if numUnseen > 0 {
+				ok = false // Candidates remain, but MaxPerDomain is hit.
+			}
+			break
+		}
+
+		seen[best] = true
+		rv = append(rv, best)
+
+		// Check whether MinDomains is still reachable with the copies
+		// that are left to be assigned.
+		left := constraints - len(rv) + remaining
+		for i, rule := range rules {
+			domainCounts[i][spreadDomain(best, rule.Level, mapParents)]++
+			if len(domainCounts[i])+left < rule.MinDomains {
+				ok = false
+			}
+		}
+	}
+
+	return rv, ok
+}
+
+// Returns up to constraints nodes from the ranked candidateNodes,
+// favoring earlier candidates, so that each domain with a quota has
+// exactly that many of the chosen nodes, where a node is in a domain
+// if the domain is the node's ancestor.  The quotas are filled first,
+// in domain name order, and any remaining slots are filled by nodes
+// that don't exceed any quota.  The returned shortDomains are those
+// domains that lacked enough candidate nodes to meet their quotas.
+func selectQuotaNodes(candidateNodes []string, constraints int,
+	quotas map[string]int, // Keyed by domain.
+	mapParents map[string]string) (rv []string, shortDomains []string) {
+	domains := make([]string, 0, len(quotas))
+	for domain := range quotas {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	counts := make(map[string]int) // Keyed by domain.
+	seen := make(map[string]bool)
+
+	// Returns the domains with quotas of a node, or nil if choosing
+	// the node would exceed a quota.
+	quotaDomains := func(node string) (nodeDomains []string, ok bool) {
+		for a := mapParents[node]; a != ""; a = mapParents[a] {
+			if quota, exists := quotas[a]; exists {
+				if counts[a] >= quota {
+					return nil, false
+				}
+				nodeDomains = append(nodeDomains, a)
+			}
+		}
+		return nodeDomains, true
+	}
+
+	choose := func(node string, nodeDomains []string) {
+		seen[node] = true
+		rv = append(rv, node)
+		for _, domain := range nodeDomains {
+			counts[domain]++
+		}
+	}
+
+	for _, domain := range domains {
+		for _, node := range candidateNodes {
+			if len(rv) >= constraints || counts[domain] >= quotas[domain] {
+				break
+			}
+			if seen[node] {
+				continue
+			}
+			nodeDomains, ok := quotaDomains(node)
+			if ok && StringsToMap(nodeDomains)[domain] {
+				choose(node, nodeDomains)
+			}
+		}
+		if counts[domain] < quotas[domain] {
+			shortDomains = append(shortDomains, domain)
+		}
+	}
+
+	for _, node := range candidateNodes {
+		if len(rv) >= constraints {
+			break
+		}
+		if seen[node] {
+			continue
+		}
+		nodeDomains, ok := quotaDomains(node)
+		if ok {
+			choose(node, nodeDomains)
+		}
+	}
+
+	return rv, shortDomains
+}
+
+// Returns the failure domain of a node at a hierarchy level, where
+// a node without an ancestor at that level is its own domain.
+func spreadDomain(node string, level int,
+	mapParents map[string]string) string {
+	domain := findAncestor(node, mapParents, level)
+	if domain == "" {
+		return node
+	}
+	return domain
+}
+
 // The includeLevel is tree ancestor inclusion level, and excludeLevel
 // is tree ancestor exclusion level.  Example: includeLevel of 2 and
 // excludeLevel of 1 means include nodes with the same grandparent
@@ -659,6 +1481,32 @@ func includeExcludeNodes(node string,
 	return StringsRemoveStrings(incNodes, excNodes)
 }
 
+// Like includeExcludeNodes(), but relative to multiple anchor nodes,
+// where the included nodes are the union of the nodes included for
+// each anchor, minus the union of the nodes excluded for each anchor.
+// For example, with includeLevel of 2 and excludeLevel of 1, the
+// result is the nodes in the same zones as the anchors, but not in
+// any rack of any anchor.
+func includeExcludeAnchorNodes(anchorNodes []string,
+	includeLevel,
+	excludeLevel int,
+	mapParents map[string]string,
+	mapChildren map[string][]string) []string {
+	var incNodes, excNodes []string
+	for _, anchorNode := range anchorNodes {
+		incNodes = append(incNodes, findLeaves(
+			findAncestor(anchorNode, mapParents, includeLevel),
+			mapChildren)...)
+		excNodes = append(excNodes, findLeaves(
+			findAncestor(anchorNode, mapParents, excludeLevel),
+			mapChildren)...)
+	}
+
+	// Intersecting incNodes with itself removes duplicates.
+	return StringsRemoveStrings(
+		StringsIntersectStrings(incNodes, incNodes), excNodes)
+}
+
 func findAncestor(node string,
 	mapParents map[string]string, level int) string {
 	for level > 0 {
@@ -229,6 +229,46 @@ func TestCountStateNodes(t *testing.T) {
 	}
 }
 
+func TestCountNodeLoads(t *testing.T) {
+	tests := []struct {
+		c   map[string]map[string]int
+		f   map[string]float64
+		exp map[string]float64
+	}{
+		{
+			map[string]map[string]int{
+				"primary": {"a": 1, "b": 1},
+				"replica": {"b": 1, "c": 2},
+			},
+			nil,
+			map[string]float64{"a": 1, "b": 2, "c": 2},
+		},
+		{
+			map[string]map[string]int{
+				"primary": {"a": 1, "b": 1},
+				"replica": {"b": 1, "c": 2},
+			},
+			map[string]float64{"replica": 0.5},
+			map[string]float64{"a": 1, "b": 1.5, "c": 1},
+		},
+		{
+			map[string]map[string]int{
+				"primary": {"a": 2},
+				"witness": {"b": 3},
+			},
+			map[string]float64{"primary": 1.0, "witness": 0.0},
+			map[string]float64{"a": 2, "b": 0},
+		},
+	}
+	for i, c := range tests {
+		r := countNodeLoads(c.c, c.f)
+		if !reflect.DeepEqual(r, c.exp) {
+			t.Errorf("i: %d, c: %#v, f: %#v, exp: %#v, got: %#v",
+				i, c.c, c.f, c.exp, r)
+		}
+	}
+}
+
 func TestPartitionMapToArrayCopy(t *testing.T) {
 	tests := []struct {
 		m   PartitionMap
@@ -2508,3 +2548,1587 @@ func Test2Replicas(t *testing.T) {
 	}
 	testVisTestCases(t, tests)
 }
+
+func TestPlanNextMapStateLoadFactor(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 0,
+		},
+	}
+	prevMap := PartitionMap{
+		"0": &Partition{
+			Name:         "0",
+			NodesByState: map[string][]string{},
+		},
+		"1": &Partition{
+			Name:         "1",
+			NodesByState: map[string][]string{},
+		},
+		"2": &Partition{
+			Name: "2",
+			NodesByState: map[string][]string{
+				"replica": {"a"},
+			},
+		},
+		"3": &Partition{
+			Name: "3",
+			NodesByState: map[string][]string{
+				"replica": {"a"},
+			},
+		},
+	}
+	tests := []struct {
+		About           string
+		StateLoadFactor map[string]float64
+		exp             map[string][]string // Keyed by partition, value is primary nodes.
+	}{
+		{
+			About:           "replicas on node a count as load",
+			StateLoadFactor: nil,
+			exp: map[string][]string{
+				"0": {"b"}, "1": {"a"}, "2": {"b"}, "3": {"a"},
+			},
+		},
+		{
+			About:           "replicas on node a count as no load",
+			StateLoadFactor: map[string]float64{"primary": 1.0, "replica": 0},
+			exp: map[string][]string{
+				"0": {"a"}, "1": {"b"}, "2": {"a"}, "3": {"b"},
+			},
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanNextMapEx(prevMap,
+			[]string{"a", "b"}, nil, []string{"a", "b"}, model,
+			PlanNextMapOptions{StateLoadFactor: c.StateLoadFactor})
+		if len(rWarnings) != 0 {
+			t.Errorf("i: %d, about: %s, unexpected warnings: %v",
+				i, c.About, rWarnings)
+		}
+		for partitionName, expNodes := range c.exp {
+			nodes := r[partitionName].NodesByState["primary"]
+			if !reflect.DeepEqual(nodes, expNodes) {
+				t.Errorf("i: %d, about: %s, partition: %s,"+
+					" exp: %v, got: %v",
+					i, c.About, partitionName, expNodes, nodes)
+			}
+		}
+	}
+}
+
+func TestStateNodeWeight(t *testing.T) {
+	stateNodeWeights := map[string]map[string]int{
+		"primary": {"a": 3, "b": 0},
+	}
+	nodeWeights := map[string]int{"a": 2, "c": 5}
+	tests := []struct {
+		stateName string
+		node      string
+		expWeight int
+		expExists bool
+	}{
+		{"primary", "a", 3, true},
+		{"primary", "b", 0, true},
+		{"primary", "c", 5, true},
+		{"primary", "d", 0, false},
+		{"replica", "a", 2, true},
+		{"replica", "b", 0, false},
+	}
+	for i, c := range tests {
+		w, exists := stateNodeWeight(stateNodeWeights, nodeWeights,
+			c.stateName, c.node)
+		if w != c.expWeight || exists != c.expExists {
+			t.Errorf("i: %d, stateName: %s, node: %s,"+
+				" expWeight: %d, expExists: %v, got: %d, %v",
+				i, c.stateName, c.node, c.expWeight, c.expExists,
+				w, exists)
+		}
+	}
+}
+
+func TestPlanNextMapStateNodeWeights(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	prevMap := PartitionMap{}
+	for i := 0; i < 8; i++ {
+		partitionName := fmt.Sprintf("%d", i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+	tests := []struct {
+		About            string
+		NodeWeights      map[string]int
+		StateNodeWeights map[string]map[string]int
+		exp              map[string]map[string]int
+	}{
+		{
+			About:       "node weights apply to every state",
+			NodeWeights: map[string]int{"a": 3},
+			exp: map[string]map[string]int{
+				"primary": {"a": 6, "b": 2},
+				"replica": {"a": 2, "b": 6},
+			},
+		},
+		{
+			About:       "state node weights override node weights",
+			NodeWeights: map[string]int{"a": 3},
+			StateNodeWeights: map[string]map[string]int{
+				"primary": {"a": 1},
+			},
+			exp: map[string]map[string]int{
+				"primary": {"a": 4, "b": 4},
+				"replica": {"a": 4, "b": 4},
+			},
+		},
+		{
+			About: "state node weights without node weights",
+			StateNodeWeights: map[string]map[string]int{
+				"primary": {"b": 3},
+			},
+			exp: map[string]map[string]int{
+				"primary": {"a": 2, "b": 6},
+				"replica": {"a": 6, "b": 2},
+			},
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanNextMapEx(prevMap,
+			[]string{"a", "b"}, nil, []string{"a", "b"}, model,
+			PlanNextMapOptions{
+				NodeWeights:      c.NodeWeights,
+				StateNodeWeights: c.StateNodeWeights,
+			})
+		if len(rWarnings) != 0 {
+			t.Errorf("i: %d, about: %s, unexpected warnings: %v",
+				i, c.About, rWarnings)
+		}
+		counts := countStateNodes(r, nil)
+		if !reflect.DeepEqual(counts, c.exp) {
+			t.Errorf("i: %d, about: %s, exp: %v, got: %v",
+				i, c.About, c.exp, counts)
+		}
+	}
+}
+
+func TestPlanNextMapZeroNodeWeight(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+	}
+	emptyMap := PartitionMap{}
+	assignedMap := PartitionMap{}
+	for i := 0; i < 6; i++ {
+		partitionName := fmt.Sprintf("%d", i)
+		emptyMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+		assignedMap[partitionName] = &Partition{
+			Name: partitionName,
+			NodesByState: map[string][]string{
+				"primary": {[]string{"a", "b", "c"}[i%3]},
+			},
+		}
+	}
+	tests := []struct {
+		About          string
+		PrevMap        PartitionMap
+		Opts           PlanNextMapOptions
+		exp            map[string]map[string]int
+		expNumWarnings int
+	}{
+		{
+			About:   "zero weight node gets no new assignments",
+			PrevMap: emptyMap,
+			Opts: PlanNextMapOptions{
+				NodeWeights: map[string]int{"c": 0},
+			},
+			exp: map[string]map[string]int{
+				"primary": {"a": 3, "b": 3},
+			},
+		},
+		{
+			About:   "zero weight node keeps existing assignments",
+			PrevMap: assignedMap,
+			Opts: PlanNextMapOptions{
+				NodeWeights: map[string]int{"c": 0},
+			},
+			exp: map[string]map[string]int{
+				"primary": {"a": 2, "b": 2, "c": 2},
+			},
+		},
+		{
+			About:   "zero weight node is drained",
+			PrevMap: assignedMap,
+			Opts: PlanNextMapOptions{
+				NodeWeights:          map[string]int{"c": 0},
+				DrainZeroWeightNodes: true,
+			},
+			exp: map[string]map[string]int{
+				"primary": {"a": 3, "b": 3},
+			},
+		},
+		{
+			About:   "zero weight nodes make constraints unsatisfiable",
+			PrevMap: emptyMap,
+			Opts: PlanNextMapOptions{
+				StateNodeWeights: map[string]map[string]int{
+					"primary": {"a": 0, "b": 0, "c": 0},
+				},
+			},
+			exp: map[string]map[string]int{
+				"primary": {},
+			},
+			expNumWarnings: 6,
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanNextMapEx(c.PrevMap,
+			[]string{"a", "b", "c"}, nil, nil, model, c.Opts)
+		if len(rWarnings) != c.expNumWarnings {
+			t.Errorf("i: %d, about: %s, expNumWarnings: %d, got: %v",
+				i, c.About, c.expNumWarnings, rWarnings)
+		}
+		counts := countStateNodes(r, nil)
+		if !reflect.DeepEqual(counts, c.exp) {
+			t.Errorf("i: %d, about: %s, exp: %v, got: %v",
+				i, c.About, c.exp, counts)
+		}
+	}
+}
+
+func TestLabelsMatch(t *testing.T) {
+	tests := []struct {
+		labels   map[string]string
+		selector map[string]string
+		exp      bool
+	}{
+		{nil, nil, true},
+		{map[string]string{"ssd": "true"}, nil, true},
+		{nil, map[string]string{"ssd": "true"}, false},
+		{map[string]string{"ssd": "true"},
+			map[string]string{"ssd": "true"}, true},
+		{map[string]string{"ssd": "false"},
+			map[string]string{"ssd": "true"}, false},
+		{map[string]string{"ssd": "true", "tier": "gold"},
+			map[string]string{"ssd": "true"}, true},
+		{map[string]string{"ssd": "true"},
+			map[string]string{"ssd": "true", "tier": "gold"}, false},
+	}
+	for i, c := range tests {
+		r := labelsMatch(c.labels, c.selector)
+		if r != c.exp {
+			t.Errorf("i: %d, labels: %v, selector: %v, exp: %v",
+				i, c.labels, c.selector, c.exp)
+		}
+	}
+}
+
+func TestPlanNextMapNodeSelectors(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	prevMap := PartitionMap{}
+	for i := 0; i < 4; i++ {
+		partitionName := fmt.Sprintf("%d", i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+	r, rWarnings := PlanNextMapDetailed(prevMap,
+		[]string{"a", "b", "c", "d"}, nil, nil, model,
+		PlanNextMapOptions{
+			NodeLabels: map[string]map[string]string{
+				"a": {"ssd": "true"},
+				"b": {"ssd": "true"},
+				"d": {"tier": "gold"},
+			},
+			StateNodeSelectors: map[string]map[string]string{
+				"primary": {"ssd": "true"},
+			},
+			PartitionNodeSelectors: map[string]map[string]string{
+				"3": {"tier": "gold"},
+			},
+		})
+	for _, partitionName := range []string{"0", "1", "2"} {
+		primaries := r[partitionName].NodesByState["primary"]
+		if len(primaries) != 1 ||
+			(primaries[0] != "a" && primaries[0] != "b") {
+			t.Errorf("expected ssd primary for partition: %s, got: %v",
+				partitionName, primaries)
+		}
+	}
+	if len(r["3"].NodesByState["primary"]) != 0 {
+		t.Errorf("expected no primary for partition 3, got: %v",
+			r["3"].NodesByState)
+	}
+	if !reflect.DeepEqual(r["3"].NodesByState["replica"], []string{"d"}) {
+		t.Errorf("expected gold replica for partition 3, got: %v",
+			r["3"].NodesByState)
+	}
+	if len(rWarnings) != 1 ||
+		rWarnings[0].Kind != WarningNodeSelectors ||
+		rWarnings[0].PartitionName != "3" ||
+		rWarnings[0].StateName != "primary" {
+		t.Errorf("expected a node selectors warning, got: %#v", rWarnings)
+	}
+}
+
+func TestTolerationTolerates(t *testing.T) {
+	taint := Taint{Key: "tenant", Value: "premium", Effect: TaintNoSchedule}
+	tests := []struct {
+		toleration Toleration
+		exp        bool
+	}{
+		{Toleration{Key: "tenant"}, true},
+		{Toleration{Key: "tenant", Value: "premium"}, true},
+		{Toleration{Key: "tenant", Value: "basic"}, false},
+		{Toleration{Key: "tenant", Effect: TaintNoSchedule}, true},
+		{Toleration{Key: "tenant", Effect: TaintPreferNoSchedule}, false},
+		{Toleration{Key: "suspect"}, false},
+		{Toleration{}, false},
+	}
+	for i, c := range tests {
+		r := c.toleration.Tolerates(taint)
+		if r != c.exp {
+			t.Errorf("i: %d, toleration: %#v, exp: %v", i, c.toleration, c.exp)
+		}
+	}
+}
+
+func TestCountUntoleratedTaints(t *testing.T) {
+	taints := []Taint{
+		{Key: "tenant", Value: "premium", Effect: TaintNoSchedule},
+		{Key: "suspect", Effect: TaintPreferNoSchedule},
+		{Key: "slow", Effect: TaintPreferNoSchedule},
+	}
+	tests := []struct {
+		tolerations []Toleration
+		effect      string
+		exp         int
+	}{
+		{nil, TaintNoSchedule, 1},
+		{nil, TaintPreferNoSchedule, 2},
+		{[]Toleration{{Key: "tenant"}}, TaintNoSchedule, 0},
+		{[]Toleration{{Key: "tenant"}}, TaintPreferNoSchedule, 2},
+		{[]Toleration{{Key: "slow"}}, TaintPreferNoSchedule, 1},
+	}
+	for i, c := range tests {
+		r := countUntoleratedTaints(taints, c.tolerations, c.effect)
+		if r != c.exp {
+			t.Errorf("i: %d, tolerations: %#v, effect: %s, exp: %d, got: %d",
+				i, c.tolerations, c.effect, c.exp, r)
+		}
+	}
+}
+
+func TestPlanNextMapTaints(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	prevMap := PartitionMap{}
+	for i := 0; i < 6; i++ {
+		partitionName := fmt.Sprintf("%d", i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+	r, rWarnings := PlanNextMapEx(prevMap,
+		[]string{"a", "b", "c"}, nil, nil, model,
+		PlanNextMapOptions{
+			NodeTaints: map[string][]Taint{
+				"b": {{Key: "suspect", Effect: TaintPreferNoSchedule}},
+				"c": {{Key: "tenant", Value: "premium", Effect: TaintNoSchedule}},
+			},
+			PartitionTolerations: map[string][]Toleration{
+				"0": {{Key: "tenant", Value: "premium"}},
+			},
+		})
+	if len(rWarnings) != 0 {
+		t.Errorf("unexpected warnings: %v", rWarnings)
+	}
+	// Only partition 0 tolerates node c, and node b is avoided for
+	// primaries, but replicas have no place to go other than node b.
+	exp := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{
+			"primary": {"c"}, "replica": {"a"},
+		}},
+	}
+	for i := 1; i < 6; i++ {
+		partitionName := fmt.Sprintf("%d", i)
+		exp[partitionName] = &Partition{
+			Name: partitionName,
+			NodesByState: map[string][]string{
+				"primary": {"a"}, "replica": {"b"},
+			},
+		}
+	}
+	if !reflect.DeepEqual(r, exp) {
+		jr, _ := json.Marshal(r)
+		jexp, _ := json.Marshal(exp)
+		t.Errorf("RESULT: %s, EXPECTED: %s", jr, jexp)
+	}
+}
+
+func TestSelectSpreadNodes(t *testing.T) {
+	mapParents := map[string]string{
+		"a": "r0", "b": "r0",
+		"c": "r1", "d": "r1",
+		"e":  "r2",
+		"r0": "z0", "r1": "z0", "r2": "z1",
+	}
+	tests := []struct {
+		candidateNodes []string
+		existingNodes  []string
+		constraints    int
+		remaining      int
+		rules          []*SpreadRule
+		exp            []string
+		expOk          bool
+	}{
+		{[]string{"a", "b", "c"}, nil, 2, 0,
+			[]*SpreadRule{{Level: 1, MaxPerDomain: 1}},
+			[]string{"a", "c"}, true},
+		{[]string{"b", "c", "d"}, []string{"a"}, 2, 0,
+			[]*SpreadRule{{Level: 1, MaxPerDomain: 1}},
+			[]string{"c"}, false},
+		{[]string{"b", "c", "d"}, []string{"a"}, 2, 0,
+			[]*SpreadRule{{Level: 1, MaxPerDomain: 2}},
+			[]string{"b", "c"}, true},
+		{[]string{"b", "c", "e"}, []string{"a"}, 1, 1,
+			[]*SpreadRule{{Level: 2, MinDomains: 2}},
+			[]string{"e"}, true},
+		{[]string{"b", "c"}, []string{"a"}, 1, 0,
+			[]*SpreadRule{{Level: 2, MinDomains: 2}},
+			[]string{"b"}, false},
+		{[]string{"b", "c", "d", "e"}, []string{"a"}, 2, 0,
+			[]*SpreadRule{{Level: 1, MinDomains: 3}},
+			[]string{"c", "e"}, true},
+		{[]string{"x", "y"}, nil, 2, 0,
+			[]*SpreadRule{{Level: 1, MaxPerDomain: 1}},
+			[]string{"x", "y"}, true},
+	}
+	for i, c := range tests {
+		r, ok := selectSpreadNodes(c.candidateNodes, c.existingNodes,
+			c.constraints, c.remaining, c.rules, mapParents)
+		if !reflect.DeepEqual(r, c.exp) || ok != c.expOk {
+			t.Errorf("i: %d, exp: %v, %v, got: %v, %v",
+				i, c.exp, c.expOk, r, ok)
+		}
+	}
+}
+
+func TestPlanNextMapSpreadRules(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 2,
+		},
+	}
+	nodeHierarchy := map[string]string{
+		"a": "z0", "b": "z0",
+		"c": "z1", "d": "z1",
+		"e": "z2", "f": "z2",
+	}
+	prevMap := PartitionMap{}
+	for i := 0; i < 12; i++ {
+		partitionName := fmt.Sprintf("%d", i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+	tests := []struct {
+		About          string
+		Nodes          []string
+		SpreadRules    []*SpreadRule
+		expNumWarnings int
+	}{
+		{
+			About:       "at most 1 copy per zone",
+			Nodes:       []string{"a", "b", "c", "d", "e", "f"},
+			SpreadRules: []*SpreadRule{{Level: 1, MaxPerDomain: 1}},
+		},
+		{
+			About:       "at least 3 zones",
+			Nodes:       []string{"a", "b", "c", "d", "e", "f"},
+			SpreadRules: []*SpreadRule{{Level: 1, MinDomains: 3}},
+		},
+		{
+			About:          "only 2 zones for 3 copies",
+			Nodes:          []string{"a", "b", "c", "d"},
+			SpreadRules:    []*SpreadRule{{Level: 1, MinDomains: 3}},
+			expNumWarnings: 12,
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanNextMapDetailed(prevMap, c.Nodes, nil, nil,
+			model, PlanNextMapOptions{
+				NodeHierarchy: nodeHierarchy,
+				SpreadRules:   c.SpreadRules,
+			})
+		if len(rWarnings) != c.expNumWarnings {
+			t.Errorf("i: %d, about: %s, expNumWarnings: %d, got: %v",
+				i, c.About, c.expNumWarnings, rWarnings)
+		}
+		for _, w := range rWarnings {
+			if w.Kind != WarningSpreadRules {
+				t.Errorf("i: %d, about: %s, unexpected warning: %#v",
+					i, c.About, w)
+			}
+		}
+		for partitionName, partition := range r {
+			nodes := flattenNodesByState(partition.NodesByState)
+			zones := map[string]bool{}
+			for _, node := range nodes {
+				zones[nodeHierarchy[node]] = true
+			}
+			if len(nodes) != 3 {
+				t.Errorf("i: %d, about: %s, partition: %s,"+
+					" expected 3 copies, got: %v",
+					i, c.About, partitionName, partition.NodesByState)
+			}
+			if c.expNumWarnings == 0 && len(zones) != 3 {
+				t.Errorf("i: %d, about: %s, partition: %s,"+
+					" expected 3 zones, got: %v",
+					i, c.About, partitionName, partition.NodesByState)
+			}
+		}
+	}
+}
+
+func TestCalcNodeDomainLoads(t *testing.T) {
+	mapParents := map[string]string{
+		"a": "r0", "b": "r0",
+		"c":  "r1",
+		"r0": "z0", "r1": "z0",
+	}
+	nodeWeights := map[string]float64{"a": 1, "b": 1, "c": 2}
+	nodeWeight := func(node string) float64 { return nodeWeights[node] }
+	tests := []struct {
+		levels     []int
+		nodeCounts map[string]int
+		exp        map[string]float64
+	}{
+		{[]int{1}, map[string]int{"a": 3},
+			map[string]float64{"a": 1.5, "b": 1.5, "c": 0}},
+		{[]int{1}, map[string]int{"a": 1, "b": 1, "c": 4},
+			map[string]float64{"a": 1, "b": 1, "c": 2}},
+		{[]int{2}, map[string]int{"a": 1, "b": 1, "c": 2},
+			map[string]float64{"a": 1, "b": 1, "c": 1}},
+		{[]int{1, 2}, map[string]int{"a": 1, "b": 1, "c": 2},
+			map[string]float64{"a": 2, "b": 2, "c": 2}},
+	}
+	for i, c := range tests {
+		r := calcNodeDomainLoads([]string{"a", "b", "c"}, c.levels,
+			c.nodeCounts, nodeWeight, mapParents)
+		if !reflect.DeepEqual(r, c.exp) {
+			t.Errorf("i: %d, levels: %v, nodeCounts: %v, exp: %v, got: %v",
+				i, c.levels, c.nodeCounts, c.exp, r)
+		}
+	}
+}
+
+func TestPlanNextMapBalanceLevels(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	nodeHierarchy := map[string]string{
+		"a": "z0", "b": "z0", "c": "z0",
+		"d": "z1", "e": "z1", "f": "z1",
+	}
+	prevMap := PartitionMap{}
+	for i := 0; i < 4; i++ {
+		partitionName := fmt.Sprintf("%d", i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+	tests := []struct {
+		About         string
+		BalanceLevels []int
+		exp           map[string]int // Keyed by zone, value is primaries.
+	}{
+		{
+			About:         "only nodes are balanced",
+			BalanceLevels: nil,
+			exp:           map[string]int{"z0": 3, "z1": 1},
+		},
+		{
+			About:         "zones are also balanced",
+			BalanceLevels: []int{1},
+			exp:           map[string]int{"z0": 2, "z1": 2},
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanNextMapEx(prevMap,
+			[]string{"a", "b", "c", "d", "e", "f"}, nil, nil, model,
+			PlanNextMapOptions{
+				NodeHierarchy: nodeHierarchy,
+				BalanceLevels: c.BalanceLevels,
+			})
+		if len(rWarnings) != 0 {
+			t.Errorf("i: %d, about: %s, unexpected warnings: %v",
+				i, c.About, rWarnings)
+		}
+		zoneCounts := map[string]int{}
+		for node, count := range countStateNodes(r, nil)["primary"] {
+			zoneCounts[nodeHierarchy[node]] += count
+		}
+		if !reflect.DeepEqual(zoneCounts, c.exp) {
+			t.Errorf("i: %d, about: %s, exp: %v, got: %v",
+				i, c.About, c.exp, zoneCounts)
+		}
+	}
+}
+
+func TestPlanNextMapHierarchyRequired(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	nodeHierarchy := map[string]string{
+		"a": "r0", "b": "r0",
+		"r0": "z0",
+	}
+	emptyMap := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{}},
+		"1": &Partition{Name: "1", NodesByState: map[string][]string{}},
+	}
+	assignedMap := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{
+			"primary": {"a"}, "replica": {"b"},
+		}},
+		"1": &Partition{Name: "1", NodesByState: map[string][]string{
+			"primary": {"a"}, "replica": {"b"},
+		}},
+	}
+	otherRack := func(required bool) *HierarchyRule {
+		return &HierarchyRule{
+			IncludeLevel: 2,
+			ExcludeLevel: 1,
+			Required:     required,
+		}
+	}
+	tests := []struct {
+		About          string
+		PrevMap        PartitionMap
+		Rules          []*HierarchyRule
+		ScopeNodes     []string
+		expNumReplicas int
+		expNumWarnings int
+		expKind        string
+	}{
+		{
+			About:          "preferred other rack falls back to same rack",
+			PrevMap:        emptyMap,
+			Rules:          []*HierarchyRule{otherRack(false)},
+			expNumReplicas: 1,
+			expNumWarnings: 2,
+			expKind:        WarningHierarchyPreferred,
+		},
+		{
+			About:          "required other rack leaves replica unfilled",
+			PrevMap:        emptyMap,
+			Rules:          []*HierarchyRule{otherRack(true)},
+			expNumReplicas: 0,
+			expNumWarnings: 2,
+			expKind:        WarningHierarchyRequired,
+		},
+		{
+			About:          "more failing required rules than constraints",
+			PrevMap:        emptyMap,
+			Rules:          []*HierarchyRule{otherRack(true), otherRack(true)},
+			expNumReplicas: 0,
+			expNumWarnings: 2,
+			expKind:        WarningHierarchyRequired,
+		},
+		{
+			About:          "required rule with out of scope replicas",
+			PrevMap:        assignedMap,
+			Rules:          []*HierarchyRule{otherRack(true)},
+			ScopeNodes:     []string{"a"},
+			expNumReplicas: 1,
+			expNumWarnings: 0,
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanNextMapDetailed(c.PrevMap,
+			[]string{"a", "b"}, nil, nil, model,
+			PlanNextMapOptions{
+				NodeHierarchy: nodeHierarchy,
+				HierarchyRules: HierarchyRules{
+					"replica": c.Rules,
+				},
+				ScopeNodes: c.ScopeNodes,
+			})
+		for partitionName, partition := range r {
+			if len(partition.NodesByState["primary"]) != 1 ||
+				len(partition.NodesByState["replica"]) != c.expNumReplicas {
+				t.Errorf("i: %d, about: %s, partition: %s, got: %v",
+					i, c.About, partitionName, partition.NodesByState)
+			}
+		}
+		if len(rWarnings) != c.expNumWarnings {
+			t.Errorf("i: %d, about: %s, expected %d warnings, got: %v",
+				i, c.About, c.expNumWarnings, rWarnings)
+		}
+		for _, w := range rWarnings {
+			if w.Kind != c.expKind || w.StateName != "replica" {
+				t.Errorf("i: %d, about: %s, unexpected warning: %#v",
+					i, c.About, w)
+			}
+		}
+	}
+}
+
+func TestIncludeExcludeAnchorNodes(t *testing.T) {
+	mapParents := map[string]string{
+		"a": "r0", "b": "r0",
+		"c": "r1", "d": "r1",
+		"e": "r2", "f": "r2",
+		"r0": "z0", "r1": "z0", "r2": "z0",
+	}
+	mapChildren := mapParentsToMapChildren(mapParents)
+	tests := []struct {
+		anchorNodes  []string
+		includeLevel int
+		excludeLevel int
+		exp          []string
+	}{
+		{[]string{"a"}, 2, 1, []string{"c", "d", "e", "f"}},
+		{[]string{"a", "c"}, 2, 1, []string{"e", "f"}},
+		{[]string{"a", "c", "e"}, 2, 1, []string{}},
+		{[]string{"a", "c"}, 1, 0, []string{"b", "d"}},
+		{[]string{"a", "b"}, 1, 0, []string{}},
+	}
+	for i, c := range tests {
+		r := includeExcludeAnchorNodes(c.anchorNodes,
+			c.includeLevel, c.excludeLevel, mapParents, mapChildren)
+		if !reflect.DeepEqual(r, c.exp) {
+			t.Errorf("i: %d, anchorNodes: %v, exp: %v, got: %v",
+				i, c.anchorNodes, c.exp, r)
+		}
+	}
+}
+
+func TestPlanNextMapHierarchyAnchorState(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 2,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	nodeHierarchy := map[string]string{
+		"a": "r0", "b": "r0",
+		"c": "r1", "d": "r1",
+		"e": "r2", "f": "r2",
+		"r0": "z0", "r1": "z0", "r2": "z0",
+	}
+	primaries := [][]string{
+		{"a", "c"}, {"c", "e"}, {"e", "a"},
+		{"b", "d"}, {"d", "f"}, {"f", "b"},
+	}
+	prevMap := PartitionMap{}
+	for i, nodes := range primaries {
+		partitionName := fmt.Sprintf("%d", i)
+		prevMap[partitionName] = &Partition{
+			Name: partitionName,
+			NodesByState: map[string][]string{
+				"primary": nodes,
+			},
+		}
+	}
+	tests := []struct {
+		About           string
+		AnchorState     string
+		expNumSameRacks int
+	}{
+		{
+			About:           "relative to the first primary only",
+			AnchorState:     "",
+			expNumSameRacks: 2,
+		},
+		{
+			About:           "relative to every primary",
+			AnchorState:     "primary",
+			expNumSameRacks: 0,
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanNextMapEx(prevMap,
+			[]string{"a", "b", "c", "d", "e", "f"}, nil, nil, model,
+			PlanNextMapOptions{
+				NodeHierarchy: nodeHierarchy,
+				HierarchyRules: HierarchyRules{
+					"replica": []*HierarchyRule{{
+						IncludeLevel: 2,
+						ExcludeLevel: 1,
+						AnchorState:  c.AnchorState,
+					}},
+				},
+			})
+		if len(rWarnings) != 0 {
+			t.Errorf("i: %d, about: %s, unexpected warnings: %v",
+				i, c.About, rWarnings)
+		}
+		numSameRacks := 0
+		for _, partition := range r {
+			racks := map[string]bool{}
+			for _, node := range partition.NodesByState["primary"] {
+				racks[nodeHierarchy[node]] = true
+			}
+			for _, node := range partition.NodesByState["replica"] {
+				if racks[nodeHierarchy[node]] {
+					numSameRacks++
+				}
+			}
+		}
+		if numSameRacks != c.expNumSameRacks {
+			t.Errorf("i: %d, about: %s, expNumSameRacks: %d, got: %d",
+				i, c.About, c.expNumSameRacks, numSameRacks)
+		}
+	}
+}
+
+func TestSelectQuotaNodes(t *testing.T) {
+	mapParents := map[string]string{
+		"a": "r0", "b": "r0", "c": "r1",
+		"d": "r2", "e": "r2",
+		"r0": "dc1", "r1": "dc1", "r2": "dc2",
+	}
+	tests := []struct {
+		candidateNodes  []string
+		constraints     int
+		quotas          map[string]int
+		exp             []string
+		expShortDomains []string
+	}{
+		{[]string{"a", "b", "c", "d", "e"}, 3,
+			map[string]int{"dc1": 2, "dc2": 1},
+			[]string{"a", "b", "d"}, nil},
+		{[]string{"d", "e", "a", "b", "c"}, 3,
+			map[string]int{"dc1": 2, "dc2": 1},
+			[]string{"a", "b", "d"}, nil},
+		{[]string{"a", "b", "c", "d", "e"}, 3,
+			map[string]int{"dc1": 1},
+			[]string{"a", "d", "e"}, nil},
+		{[]string{"a", "b", "c", "d", "e"}, 3,
+			map[string]int{"dc1": 2, "r0": 1},
+			[]string{"a", "c", "d"}, nil},
+		{[]string{"a", "b", "d"}, 3,
+			map[string]int{"dc1": 1, "dc2": 2},
+			[]string{"a", "d"}, []string{"dc2"}},
+	}
+	for i, c := range tests {
+		r, shortDomains := selectQuotaNodes(c.candidateNodes,
+			c.constraints, c.quotas, mapParents)
+		if !reflect.DeepEqual(r, c.exp) ||
+			!reflect.DeepEqual(shortDomains, c.expShortDomains) {
+			t.Errorf("i: %d, exp: %v, %v, got: %v, %v",
+				i, c.exp, c.expShortDomains, r, shortDomains)
+		}
+	}
+}
+
+func TestPlanNextMapDomainStateQuotas(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 3,
+		},
+	}
+	nodeHierarchy := map[string]string{
+		"a": "dc1", "b": "dc1", "c": "dc1",
+		"d": "dc2", "e": "dc2",
+	}
+	prevMap := PartitionMap{}
+	for i := 0; i < 4; i++ {
+		partitionName := fmt.Sprintf("%d", i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+	tests := []struct {
+		About          string
+		Nodes          []string
+		exp            map[string]int // Keyed by domain, value is replicas.
+		expNumWarnings int
+	}{
+		{
+			About: "2 replicas in dc1 and 1 replica in dc2",
+			Nodes: []string{"a", "b", "c", "d", "e"},
+			exp:   map[string]int{"dc1": 2, "dc2": 1},
+		},
+		{
+			About:          "dc2 lacks capacity",
+			Nodes:          []string{"a", "b", "c"},
+			exp:            map[string]int{"dc1": 2},
+			expNumWarnings: 8,
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanNextMapDetailed(prevMap, c.Nodes, nil, nil,
+			model, PlanNextMapOptions{
+				NodeHierarchy: nodeHierarchy,
+				DomainStateQuotas: map[string]map[string]int{
+					"dc1": {"primary": 1, "replica": 2},
+					"dc2": {"replica": 1},
+				},
+			})
+		if len(rWarnings) != c.expNumWarnings {
+			t.Errorf("i: %d, about: %s, expNumWarnings: %d, got: %v",
+				i, c.About, c.expNumWarnings, rWarnings)
+		}
+		for partitionName, partition := range r {
+			primaries := partition.NodesByState["primary"]
+			if len(primaries) != 1 || nodeHierarchy[primaries[0]] != "dc1" {
+				t.Errorf("i: %d, about: %s, partition: %s,"+
+					" expected primary in dc1, got: %v",
+					i, c.About, partitionName, partition.NodesByState)
+			}
+			counts := map[string]int{}
+			for _, node := range partition.NodesByState["replica"] {
+				counts[nodeHierarchy[node]]++
+			}
+			if !reflect.DeepEqual(counts, c.exp) {
+				t.Errorf("i: %d, about: %s, partition: %s, exp: %v, got: %v",
+					i, c.About, partitionName, c.exp, counts)
+			}
+		}
+	}
+}
+
+func TestCalcStatePreferredNodes(t *testing.T) {
+	mapChildren := mapParentsToMapChildren(map[string]string{
+		"a": "z0", "b": "z0", "c": "z1", "d": "z1",
+	})
+	r := calcStatePreferredNodes(PlanNextMapOptions{
+		PreferredNodes: map[string][]string{
+			"primary": {"a"},
+			"replica": {"b"},
+		},
+		PreferredDomains: map[string][]string{
+			"primary": {"z1"},
+		},
+	}, mapChildren)
+	exp := map[string]map[string]bool{
+		"primary": {"a": true, "c": true, "d": true},
+		"replica": {"b": true},
+	}
+	if !reflect.DeepEqual(r, exp) {
+		t.Errorf("exp: %v, got: %v", exp, r)
+	}
+}
+
+func TestPlanNextMapPreferredDomains(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	nodeHierarchy := map[string]string{
+		"a": "z0", "b": "z0",
+		"c": "z1", "d": "z1",
+	}
+	prevMap := PartitionMap{}
+	for i := 0; i < 8; i++ {
+		partitionName := fmt.Sprintf("%d", i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+	tests := []struct {
+		About            string
+		PreferredDomains map[string][]string
+		PreferredBonus   float64
+		exp              map[string]int // Keyed by zone, value is primaries.
+		expNumWarnings   int
+	}{
+		{
+			About: "no preferences",
+			exp:   map[string]int{"z0": 4, "z1": 4},
+		},
+		{
+			About: "default bonus, when balance allows",
+			PreferredDomains: map[string][]string{
+				"primary": {"z1"},
+			},
+			exp:            map[string]int{"z0": 2, "z1": 6},
+			expNumWarnings: 1,
+		},
+		{
+			About: "large bonus",
+			PreferredDomains: map[string][]string{
+				"primary": {"z1"},
+			},
+			PreferredBonus: 4,
+			exp:            map[string]int{"z1": 8},
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanNextMapDetailed(prevMap,
+			[]string{"a", "b", "c", "d"}, nil, nil, model,
+			PlanNextMapOptions{
+				NodeHierarchy:    nodeHierarchy,
+				PreferredDomains: c.PreferredDomains,
+				PreferredBonus:   c.PreferredBonus,
+			})
+		if len(rWarnings) != c.expNumWarnings {
+			t.Errorf("i: %d, about: %s, expNumWarnings: %d, got: %v",
+				i, c.About, c.expNumWarnings, rWarnings)
+		}
+		for _, w := range rWarnings {
+			if w.Kind != WarningPreferredPlacement {
+				t.Errorf("i: %d, about: %s, unexpected warning: %#v",
+					i, c.About, w)
+			}
+		}
+		zoneCounts := map[string]int{}
+		for node, count := range countStateNodes(r, nil)["primary"] {
+			if count > 0 {
+				zoneCounts[nodeHierarchy[node]] += count
+			}
+		}
+		if !reflect.DeepEqual(zoneCounts, c.exp) {
+			t.Errorf("i: %d, about: %s, exp: %v, got: %v",
+				i, c.About, c.exp, zoneCounts)
+		}
+	}
+}
+
+func TestPlanNextMapScope(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	emptyMap := PartitionMap{}
+	for i := 0; i < 12; i++ {
+		partitionName := fmt.Sprintf("%02d", i)
+		emptyMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+	prevMap, _ := PlanNextMapEx(emptyMap, []string{"a", "b", "c"},
+		nil, nil, model, PlanNextMapOptions{})
+
+	nodesAll := []string{"a", "b", "c", "d"}
+
+	// Only the scoped partitions may move to the added node.
+	scopePartitions := []string{"00", "01", "02", "03", "04", "05"}
+	r, rWarnings := PlanNextMapDetailed(prevMap, nodesAll, nil,
+		[]string{"d"}, model, PlanNextMapOptions{
+			ScopePartitions: scopePartitions,
+		})
+	if len(rWarnings) != 0 {
+		t.Errorf("expected no warnings, got: %v", rWarnings)
+	}
+	for partitionName, partition := range r {
+		if StringsToMap(scopePartitions)[partitionName] {
+			continue
+		}
+		if !reflect.DeepEqual(partition, prevMap[partitionName]) {
+			t.Errorf("partition: %s, expected frozen, got: %v",
+				partitionName, partition.NodesByState)
+		}
+	}
+	// The frozen partitions count towards the load of a, b and c, so
+	// d takes more than its even share of the scoped partitions.
+	loads := countNodeLoads(countStateNodes(r, nil), nil)
+	if loads["d"] < 5 || loads["d"] > 7 {
+		t.Errorf("expected d to be filled up, got: %v", loads)
+	}
+
+	// Only the assignments on the scoped nodes may change.
+	scopeNodes := []string{"a", "d"}
+	r, rWarnings = PlanNextMapDetailed(prevMap, nodesAll, nil,
+		[]string{"d"}, model, PlanNextMapOptions{
+			ScopeNodes: scopeNodes,
+		})
+	if len(rWarnings) != 0 {
+		t.Errorf("expected no warnings, got: %v", rWarnings)
+	}
+	for partitionName, partition := range r {
+		for _, stateName := range []string{"primary", "replica"} {
+			frozen := StringsRemoveStrings(
+				prevMap[partitionName].NodesByState[stateName], scopeNodes)
+			if len(StringsRemoveStrings(frozen,
+				partition.NodesByState[stateName])) != 0 {
+				t.Errorf("partition: %s, expected frozen: %v, got: %v",
+					partitionName, frozen, partition.NodesByState)
+			}
+		}
+	}
+	loads = countNodeLoads(countStateNodes(r, nil), nil)
+	if loads["d"] <= 0 || loads["b"] != 8 || loads["c"] != 8 {
+		t.Errorf("expected d to take load from a only, got: %v", loads)
+	}
+}
+
+func TestPlanNextMapBalanceTolerance(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	// The loads of a, b and c are 8, 9 and 7, where the primaries are
+	// 5, 4 and 3 and the replicas are 3, 5 and 4.
+	pairs := []string{"ab", "bc", "ca", "ab", "bc", "ca",
+		"ab", "bc", "ca", "ab", "bc", "ab"}
+	prevMap := PartitionMap{}
+	for i, pair := range pairs {
+		partitionName := fmt.Sprintf("%02d", i)
+		prevMap[partitionName] = &Partition{
+			Name: partitionName,
+			NodesByState: map[string][]string{
+				"primary": {pair[:1]},
+				"replica": {pair[1:]},
+			},
+		}
+	}
+	tests := []struct {
+		About            string
+		Nodes            []string
+		NodesToRemove    []string
+		NodesToAdd       []string
+		BalanceTolerance float64
+		StateNodeWeights map[string]map[string]int
+		expNumChanged    int
+		expLoads         map[string]float64
+	}{
+		{
+			About:         "no tolerance",
+			Nodes:         []string{"a", "b", "c"},
+			expNumChanged: 1,
+			expLoads:      map[string]float64{"a": 8, "b": 8, "c": 8},
+		},
+		{
+			About:            "within tolerance",
+			Nodes:            []string{"a", "b", "c"},
+			BalanceTolerance: 0.3,
+			expNumChanged:    0,
+			expLoads:         map[string]float64{"a": 8, "b": 9, "c": 7},
+		},
+		{
+			About:         "add a node",
+			Nodes:         []string{"a", "b", "c", "d"},
+			NodesToAdd:    []string{"d"},
+			expNumChanged: 6,
+			expLoads: map[string]float64{
+				"a": 6, "b": 6, "c": 6, "d": 6,
+			},
+		},
+		{
+			About:            "add a node, only move until within tolerance",
+			Nodes:            []string{"a", "b", "c", "d"},
+			NodesToAdd:       []string{"d"},
+			BalanceTolerance: 0.4,
+			expNumChanged:    4,
+			expLoads: map[string]float64{
+				"a": 7, "b": 7, "c": 6, "d": 4,
+			},
+		},
+		{
+			About:            "swap a node, removals are always moved",
+			Nodes:            []string{"a", "b", "c", "d"},
+			NodesToRemove:    []string{"c"},
+			NodesToAdd:       []string{"d"},
+			BalanceTolerance: 0.3,
+			expNumChanged:    7,
+			expLoads: map[string]float64{
+				"a": 9, "b": 9, "d": 6,
+			},
+		},
+		{
+			About:            "state node weights change the fair share",
+			Nodes:            []string{"a", "b", "c"},
+			BalanceTolerance: 0.3,
+			StateNodeWeights: map[string]map[string]int{
+				"primary": {"a": 1, "b": 1, "c": 4},
+			},
+			expNumChanged: 4,
+			expLoads: map[string]float64{
+				"a": 7, "b": 7, "c": 10,
+			},
+		},
+	}
+	for i, c := range tests {
+		r, _ := PlanNextMapEx(prevMap, c.Nodes, c.NodesToRemove,
+			c.NodesToAdd, model, PlanNextMapOptions{
+				BalanceTolerance: c.BalanceTolerance,
+				StateNodeWeights: c.StateNodeWeights,
+			})
+		numChanged := 0
+		for partitionName, partition := range r {
+			if !reflect.DeepEqual(partition, prevMap[partitionName]) {
+				numChanged++
+			}
+		}
+		if numChanged != c.expNumChanged {
+			t.Errorf("i: %d, about: %s, expNumChanged: %d, got: %d",
+				i, c.About, c.expNumChanged, numChanged)
+		}
+		loads := countNodeLoads(countStateNodes(r, nil), nil)
+		for node, load := range loads {
+			if load == 0 {
+				delete(loads, node)
+			}
+		}
+		if !reflect.DeepEqual(loads, c.expLoads) {
+			t.Errorf("i: %d, about: %s, expLoads: %v, got: %v",
+				i, c.About, c.expLoads, loads)
+		}
+	}
+}
+
+func TestPlanNextMapBalanceTolerancePerState(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	// Every node has a load of 8, but every primary is on a.
+	prevMap := PartitionMap{}
+	for i := 0; i < 8; i++ {
+		partitionName := fmt.Sprintf("%02d", i)
+		prevMap[partitionName] = &Partition{
+			Name: partitionName,
+			NodesByState: map[string][]string{
+				"primary": {"a"},
+				"replica": {"b"},
+			},
+		}
+	}
+	for i, tolerance := range []float64{0, 0.1} {
+		r, _ := PlanNextMapEx(prevMap, []string{"a", "b"}, nil, nil,
+			model, PlanNextMapOptions{BalanceTolerance: tolerance})
+		exp := map[string]map[string]int{
+			"primary": {"a": 4, "b": 4},
+			"replica": {"a": 4, "b": 4},
+		}
+		got := countStateNodes(r, nil)
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("i: %d, tolerance: %v, exp: %v, got: %v",
+				i, tolerance, exp, got)
+		}
+	}
+}
+
+func TestPlanNextMapBalanceToleranceRules(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	// The loads of a, b and c are 8, 9 and 7, which is within a
+	// BalanceTolerance of 0.5.
+	pairs := []string{"ab", "bc", "ca", "ab", "bc", "ca",
+		"ab", "bc", "ca", "ab", "bc", "ab"}
+	prevMap := PartitionMap{}
+	for i, pair := range pairs {
+		partitionName := fmt.Sprintf("%02d", i)
+		prevMap[partitionName] = &Partition{
+			Name: partitionName,
+			NodesByState: map[string][]string{
+				"primary": {pair[:1]},
+				"replica": {pair[1:]},
+			},
+		}
+	}
+	nodeHierarchy := map[string]string{
+		"a": "r0", "b": "r0", "c": "r1",
+	}
+	// Returns true if the partition has no copies on node c.
+	avoidsC := func(partition *Partition) bool {
+		return !StringsToMap(
+			flattenNodesByState(partition.NodesByState))["c"]
+	}
+	tests := []struct {
+		About string
+		Opts  PlanNextMapOptions
+		ok    func(partition *Partition) bool
+	}{
+		{
+			About: "NoSchedule taint",
+			Opts: PlanNextMapOptions{
+				NodeTaints: map[string][]Taint{
+					"c": {{Key: "k", Effect: TaintNoSchedule}},
+				},
+			},
+			ok: avoidsC,
+		},
+		{
+			About: "drain zero weight node",
+			Opts: PlanNextMapOptions{
+				NodeWeights:          map[string]int{"c": 0},
+				DrainZeroWeightNodes: true,
+			},
+			ok: avoidsC,
+		},
+		{
+			About: "drain zero state node weight",
+			Opts: PlanNextMapOptions{
+				StateNodeWeights: map[string]map[string]int{
+					"primary": {"c": 0},
+				},
+				DrainZeroWeightNodes: true,
+			},
+			ok: func(partition *Partition) bool {
+				return partition.NodesByState["primary"][0] != "c"
+			},
+		},
+		{
+			About: "state node selector",
+			Opts: PlanNextMapOptions{
+				NodeLabels: map[string]map[string]string{
+					"a": {"disk": "ssd"}, "b": {"disk": "ssd"},
+				},
+				StateNodeSelectors: map[string]map[string]string{
+					"primary": {"disk": "ssd"},
+				},
+			},
+			ok: func(partition *Partition) bool {
+				return partition.NodesByState["primary"][0] != "c"
+			},
+		},
+		{
+			About: "spread rule",
+			Opts: PlanNextMapOptions{
+				NodeHierarchy: nodeHierarchy,
+				SpreadRules:   []*SpreadRule{{Level: 1, MaxPerDomain: 1}},
+			},
+			ok: func(partition *Partition) bool {
+				return !avoidsC(partition)
+			},
+		},
+		{
+			About: "required hierarchy rule",
+			Opts: PlanNextMapOptions{
+				NodeHierarchy: map[string]string{
+					"a": "r0", "b": "r0", "c": "r1",
+					"r0": "z0", "r1": "z0",
+				},
+				HierarchyRules: HierarchyRules{
+					"replica": []*HierarchyRule{{
+						IncludeLevel: 2, ExcludeLevel: 1, Required: true,
+					}},
+				},
+			},
+			ok: func(partition *Partition) bool {
+				return !avoidsC(partition)
+			},
+		},
+		{
+			About: "copysets",
+			Opts: PlanNextMapOptions{
+				Copysets: [][]string{{"a", "c"}, {"b", "c"}},
+			},
+			ok: func(partition *Partition) bool {
+				return !avoidsC(partition)
+			},
+		},
+	}
+	for i, c := range tests {
+		for _, balanceTolerance := range []float64{0, 0.5} {
+			opts := c.Opts
+			opts.BalanceTolerance = balanceTolerance
+			r, _ := PlanNextMapEx(prevMap, []string{"a", "b", "c"},
+				nil, nil, model, opts)
+			for partitionName, partition := range r {
+				if !c.ok(partition) {
+					t.Errorf("i: %d, about: %s, balanceTolerance: %v,"+
+						" partition: %s, unexpected: %v", i, c.About,
+						balanceTolerance, partitionName,
+						partition.NodesByState)
+				}
+			}
+		}
+	}
+}
+
+func TestPlanNextMapBalanceToleranceQuotas(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	nodeHierarchy := map[string]string{
+		"a": "dc1", "b": "dc1", "c": "dc2", "d": "dc2",
+	}
+	// The pairs are the primary and replica of each partition, where
+	// every replica is in dc1.
+	partitionMap := func(pairs ...string) PartitionMap {
+		rv := PartitionMap{}
+		for i, pair := range pairs {
+			partitionName := fmt.Sprintf("%02d", i)
+			rv[partitionName] = &Partition{
+				Name: partitionName,
+				NodesByState: map[string][]string{
+					"primary": {pair[:1]},
+					"replica": {pair[1:]},
+				},
+			}
+		}
+		return rv
+	}
+	prevMap := partitionMap("ab", "ba", "ab", "ba", "ab", "ba", "ab", "ba")
+	tests := []struct {
+		About            string
+		PrevMap          PartitionMap
+		NodeWeights      map[string]int
+		BalanceTolerance float64
+		expStateNodes    map[string]map[string]int
+		expNumWarnings   int
+	}{
+		{
+			About:   "no tolerance",
+			PrevMap: prevMap,
+			expStateNodes: map[string]map[string]int{
+				"primary": {"a": 2, "b": 2, "c": 2, "d": 2},
+				"replica": {"c": 4, "d": 4},
+			},
+		},
+		{
+			About:            "the quota is met even when within tolerance",
+			PrevMap:          prevMap,
+			BalanceTolerance: 0.2,
+			expStateNodes: map[string]map[string]int{
+				"primary": {"a": 2, "b": 2, "c": 2, "d": 2},
+				"replica": {"c": 4, "d": 4},
+			},
+		},
+		{
+			About: "an unmet quota is reported for the partitions" +
+				" that kept their assignments",
+			PrevMap: partitionMap("ab", "ba", "ab", "ba", "ab",
+				"ba", "ab", "ba", "ab", "ab"),
+			NodeWeights:      map[string]int{"c": 0, "d": 0},
+			BalanceTolerance: 0.3,
+			expStateNodes: map[string]map[string]int{
+				"primary": {"a": 6, "b": 4},
+				"replica": {"a": 4, "b": 6},
+			},
+			expNumWarnings: 10,
+		},
+	}
+	for i, c := range tests {
+		r, warnings := PlanNextMapEx(c.PrevMap,
+			[]string{"a", "b", "c", "d"}, nil, nil, model,
+			PlanNextMapOptions{
+				NodeHierarchy: nodeHierarchy,
+				NodeWeights:   c.NodeWeights,
+				DomainStateQuotas: map[string]map[string]int{
+					"dc2": {"replica": 1},
+				},
+				BalanceTolerance: c.BalanceTolerance,
+			})
+		stateNodes := countStateNodes(r, nil)
+		if !reflect.DeepEqual(stateNodes, c.expStateNodes) {
+			t.Errorf("i: %d, about: %s, expStateNodes: %v, got: %v",
+				i, c.About, c.expStateNodes, stateNodes)
+		}
+		if len(warnings) != c.expNumWarnings {
+			t.Errorf("i: %d, about: %s, expNumWarnings: %d, got: %v",
+				i, c.About, c.expNumWarnings, warnings)
+		}
+	}
+}
+
+func TestApplyBalanceToleranceZeroWeight(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+	}
+	primaries := func(nodes ...string) PartitionMap {
+		rv := PartitionMap{}
+		for i, node := range nodes {
+			partitionName := fmt.Sprintf("%d", i)
+			rv[partitionName] = &Partition{
+				Name: partitionName,
+				NodesByState: map[string][]string{
+					"primary": {node},
+				},
+			}
+		}
+		return rv
+	}
+	begMap := primaries("a", "b", "c", "c")
+	endMap := primaries("a", "b", "a", "b")
+
+	// The a and b are balanced with each other, but the load on the
+	// zero weight c is out of tolerance.
+	r, kept := applyBalanceTolerance(begMap, endMap, []string{"a", "b", "c"},
+		nil, nil, model, PlanNextMapOptions{
+			NodeWeights:      map[string]int{"c": 0},
+			BalanceTolerance: 0.5,
+		})
+	if !reflect.DeepEqual(r, endMap) {
+		t.Errorf("exp: %v, got: %v", endMap, r)
+	}
+	if len(kept) != 0 {
+		t.Errorf("expected no kept partitions, got: %v", kept)
+	}
+}
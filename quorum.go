@@ -0,0 +1,74 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"sort"
+)
+
+// A QuorumViolation represents a partition where a single failure
+// domain holds a majority of the partition's copies, so that losing
+// that domain would also lose the partition's quorum.
+type QuorumViolation struct {
+	Partition string `json:"partition"`
+	Domain    string `json:"domain"`
+	Copies    int    `json:"copies"` // Copies held by the Domain.
+	Total     int    `json:"total"`  // Copies across every state.
+}
+
+// CheckQuorumSafe returns the partitions of the partitionMap where a
+// single failure domain, at the given level of the nodeHierarchy,
+// holds a majority (n/2 + 1) of the n copies of the partition,
+// counted across every state.  The nodeHierarchy is keyed by node
+// and a value is the node's parent.  The result is ordered by
+// partition name, so an empty result means the partitionMap is
+// quorum safe.
+func CheckQuorumSafe(partitionMap PartitionMap,
+	nodeHierarchy map[string]string, level int) []QuorumViolation {
+	var rv []QuorumViolation
+
+	partitionNames := make([]string, 0, len(partitionMap))
+	for partitionName := range partitionMap {
+		partitionNames = append(partitionNames, partitionName)
+	}
+	sort.Strings(partitionNames)
+
+	for _, partitionName := range partitionNames {
+		partition := partitionMap[partitionName]
+		nodes := flattenNodesByState(partition.NodesByState)
+		nodes = StringsIntersectStrings(nodes, nodes) // Remove dupes.
+
+		domainCounts := map[string]int{}
+		for _, node := range nodes {
+			domainCounts[spreadDomain(node, level, nodeHierarchy)]++
+		}
+
+		domains := make([]string, 0, len(domainCounts))
+		for domain := range domainCounts {
+			domains = append(domains, domain)
+		}
+		sort.Strings(domains)
+
+		for _, domain := range domains {
+			if domainCounts[domain] >= len(nodes)/2+1 {
+				rv = append(rv, QuorumViolation{
+					Partition: partitionName,
+					Domain:    domain,
+					Copies:    domainCounts[domain],
+					Total:     len(nodes),
+				})
+			}
+		}
+	}
+
+	return rv
+}
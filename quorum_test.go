@@ -0,0 +1,158 @@
+package blance
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCheckQuorumSafe(t *testing.T) {
+	nodeHierarchy := map[string]string{
+		"a": "z0", "b": "z0", "c": "z1", "d": "z2",
+	}
+	tests := []struct {
+		m   PartitionMap
+		exp []QuorumViolation
+	}{
+		{PartitionMap{}, nil},
+		{
+			PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"primary": {"a"},
+					"replica": {"c", "d"},
+				}},
+			},
+			nil,
+		},
+		{
+			PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"primary": {"a"},
+					"replica": {"b", "c"},
+				}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"primary": {"c"},
+					"replica": {"a", "d"},
+				}},
+			},
+			[]QuorumViolation{
+				{Partition: "0", Domain: "z0", Copies: 2, Total: 3},
+			},
+		},
+		{
+			PartitionMap{
+				"0": &Partition{Name: "0", NodesByState: map[string][]string{
+					"primary": {"a"},
+					"replica": {"c"},
+				}},
+				"1": &Partition{Name: "1", NodesByState: map[string][]string{
+					"primary": {"a", "b"},
+					"replica": {"c", "d"},
+				}},
+			},
+			nil,
+		},
+	}
+	for i, c := range tests {
+		r := CheckQuorumSafe(c.m, nodeHierarchy, 1)
+		if !reflect.DeepEqual(r, c.exp) {
+			t.Errorf("i: %d, exp: %#v, got: %#v", i, c.exp, r)
+		}
+	}
+}
+
+func TestPlanNextMapQuorumSafe(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 2,
+		},
+	}
+	singleCopyModel := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+	}
+	nodeHierarchy := map[string]string{
+		"a": "z0", "b": "z0", "c": "z0",
+		"d": "z1", "e": "z1",
+		"f": "z2",
+	}
+	prevMap := PartitionMap{}
+	for i := 0; i < 6; i++ {
+		partitionName := fmt.Sprintf("%d", i)
+		prevMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+	tests := []struct {
+		About         string
+		Model         PartitionModel
+		SpreadRules   []*SpreadRule
+		expWarnings   bool
+		expViolations bool
+	}{
+		{
+			About:         "without quorum safe rule",
+			Model:         model,
+			SpreadRules:   nil,
+			expViolations: true,
+		},
+		{
+			About:         "with quorum safe rule",
+			Model:         model,
+			SpreadRules:   []*SpreadRule{{Level: 1, QuorumSafe: true}},
+			expViolations: false,
+		},
+		{
+			About:         "single copy can't be quorum safe",
+			Model:         singleCopyModel,
+			SpreadRules:   []*SpreadRule{{Level: 1, QuorumSafe: true}},
+			expWarnings:   true,
+			expViolations: true,
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanNextMapDetailed(prevMap,
+			[]string{"a", "b", "c", "d", "e", "f"}, nil, nil, c.Model,
+			PlanNextMapOptions{
+				NodeHierarchy: nodeHierarchy,
+				SpreadRules:   c.SpreadRules,
+			})
+		if (len(rWarnings) > 0) != c.expWarnings {
+			t.Errorf("i: %d, about: %s, expWarnings: %v, got: %v",
+				i, c.About, c.expWarnings, rWarnings)
+		}
+		for _, w := range rWarnings {
+			if w.Kind != WarningSpreadRules {
+				t.Errorf("i: %d, about: %s, unexpected warning: %#v",
+					i, c.About, w)
+			}
+		}
+		violations := CheckQuorumSafe(r, nodeHierarchy, 1)
+		if (len(violations) > 0) != c.expViolations {
+			t.Errorf("i: %d, about: %s, expViolations: %v, got: %v",
+				i, c.About, c.expViolations, violations)
+		}
+
+		// With a quorum safe rule, the planner warns about exactly
+		// the partitions that the checker flags.
+		if len(c.SpreadRules) > 0 {
+			warned := map[string]bool{}
+			for _, w := range rWarnings {
+				warned[w.PartitionName] = true
+			}
+			flagged := map[string]bool{}
+			for _, v := range violations {
+				flagged[v.Partition] = true
+			}
+			if !reflect.DeepEqual(warned, flagged) {
+				t.Errorf("i: %d, about: %s, warned: %v, flagged: %v",
+					i, c.About, warned, flagged)
+			}
+		}
+	}
+}
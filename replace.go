@@ -0,0 +1,157 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"fmt"
+	"sort"
+)
+
+// PairNodeReplacements pairs each of the nodesToRemove with one of
+// the nodesToAdd, for use as the NodeReplacements of the
+// PlanNextMapOptions.  A node to remove is paired with the node to
+// add that shares its closest ancestor in the nodeHierarchy (e.g.,
+// the same rack, and then the same zone), with ties going to the
+// earliest node by name.  The nodeHierarchy is optional and is keyed
+// by node, where a value is the node's parent.  When the counts
+// differ, the extra nodes are left unpaired.
+func PairNodeReplacements(nodesToRemove, nodesToAdd []string,
+	nodeHierarchy map[string]string) map[string]string {
+	oldNodes := append([]string(nil), nodesToRemove...)
+	sort.Strings(oldNodes)
+
+	newNodes := append([]string(nil), nodesToAdd...)
+	sort.Strings(newNodes)
+
+	rv := map[string]string{}
+	used := map[string]bool{}
+
+	for _, oldNode := range oldNodes {
+		oldAncestors := ancestors(oldNode, nodeHierarchy)
+
+		best, bestLevel := "", 0
+		for _, newNode := range newNodes {
+			if used[newNode] {
+				continue
+			}
+			newAncestors := ancestors(newNode, nodeHierarchy)
+
+			// The level of the closest common ancestor, if any.
+			level := len(oldAncestors) + 1
+			for i := 0; i < len(oldAncestors) && i < len(newAncestors); i++ {
+				if oldAncestors[i] == newAncestors[i] {
+					level = i
+					break
+				}
+			}
+
+			if best == "" || level < bestLevel {
+				best, bestLevel = newNode, level
+			}
+		}
+
+		if best == "" {
+			break
+		}
+		rv[oldNode] = best
+		used[best] = true
+	}
+
+	return rv
+}
+
+// Returns the ancestors of the node, starting from its parent.
+func ancestors(node string, nodeHierarchy map[string]string) []string {
+	var rv []string
+	seen := map[string]bool{node: true} // Guard against cycles.
+	for {
+		parent := nodeHierarchy[node]
+		if parent == "" || seen[parent] {
+			return rv
+		}
+		rv = append(rv, parent)
+		seen[parent] = true
+		node = parent
+	}
+}
+
+// Returns the valid node replacements of the options, keyed by the
+// node to remove, where a value is the node to add, along with a
+// warning for each invalid replacement.  A replacement is valid when
+// its old node is in the nodesToRemove and its new node is in the
+// nodesToAdd and is not the replacement of another node.
+func calcNodeReplacements(nodesToRemove, nodesToAdd []string,
+	opts PlanNextMapOptions) (map[string]string, []*Warning) {
+	replacements := opts.NodeReplacements
+	if replacements == nil && opts.AutoNodeReplacements {
+		replacements = PairNodeReplacements(nodesToRemove, nodesToAdd,
+			opts.NodeHierarchy)
+	}
+	if len(replacements) <= 0 {
+		return nil, nil
+	}
+
+	oldNodes := make([]string, 0, len(replacements))
+	for oldNode := range replacements {
+		oldNodes = append(oldNodes, oldNode)
+	}
+	sort.Strings(oldNodes)
+
+	removes := StringsToMap(nodesToRemove)
+	adds := StringsToMap(nodesToAdd)
+
+	rv := map[string]string{}
+	used := map[string]bool{}
+
+	var warnings []*Warning
+	for _, oldNode := range oldNodes {
+		newNode := replacements[oldNode]
+		if !removes[oldNode] || !adds[newNode] || used[newNode] {
+			warnings = append(warnings, &Warning{
+				Kind: WarningNodeReplacements,
+				Message: fmt.Sprintf("ignored invalid node replacement,"+
+					" oldNode: %s, newNode: %s", oldNode, newNode),
+			})
+			continue
+		}
+		rv[oldNode] = newNode
+		used[newNode] = true
+	}
+
+	return rv, warnings
+}
+
+// Returns a copy of the partitionMap where the nodes that are keys of
+// the replacements are replaced by the values of the replacements.
+func replaceNodesInMap(partitionMap PartitionMap,
+	replacements map[string]string) PartitionMap {
+	rv := make(PartitionMap, len(partitionMap))
+	for partitionName, partition := range partitionMap {
+		nodesByState := make(map[string][]string)
+		for stateName, nodes := range partition.NodesByState {
+			nodesByState[stateName] = make([]string, 0, len(nodes))
+			for _, node := range nodes {
+				if newNode, exists := replacements[node]; exists {
+					node = newNode
+				}
+				nodesByState[stateName] =
+					append(nodesByState[stateName], node)
+			}
+		}
+		rv[partitionName] = &Partition{
+			Name:         partition.Name,
+			NodesByState: nodesByState,
+			KeyRange:     partition.KeyRange,
+		}
+	}
+	return rv
+}
@@ -0,0 +1,131 @@
+package blance
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestPairNodeReplacements(t *testing.T) {
+	nodeHierarchy := map[string]string{
+		"a": "r0", "b": "r1", "c": "r2",
+		"x": "r1", "y": "r2", "z": "r0",
+		"r0": "z0", "r1": "z0", "r2": "z1",
+	}
+	tests := []struct {
+		nodesToRemove []string
+		nodesToAdd    []string
+		nodeHierarchy map[string]string
+		exp           map[string]string
+	}{
+		{nil, nil, nil, map[string]string{}},
+		{[]string{"b", "a"}, []string{"y", "x"}, nil,
+			map[string]string{"a": "x", "b": "y"}},
+		{[]string{"a", "b", "c"}, []string{"x", "y", "z"}, nodeHierarchy,
+			map[string]string{"a": "z", "b": "x", "c": "y"}},
+		{[]string{"a", "c"}, []string{"x", "y"}, nodeHierarchy,
+			map[string]string{"a": "x", "c": "y"}},
+		{[]string{"a", "b"}, []string{"y"}, nodeHierarchy,
+			map[string]string{"a": "y"}},
+	}
+	for i, c := range tests {
+		r := PairNodeReplacements(c.nodesToRemove, c.nodesToAdd,
+			c.nodeHierarchy)
+		if !reflect.DeepEqual(r, c.exp) {
+			t.Errorf("i: %d, exp: %v, got: %v", i, c.exp, r)
+		}
+	}
+}
+
+func TestPlanNextMapNodeReplacements(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	nodeHierarchy := map[string]string{
+		"a": "r0", "b": "r0", "c": "r1", "d": "r1",
+		"x": "r0", "y": "r1",
+	}
+	emptyMap := PartitionMap{}
+	for i := 0; i < 16; i++ {
+		partitionName := fmt.Sprintf("%02d", i)
+		emptyMap[partitionName] = &Partition{
+			Name:         partitionName,
+			NodesByState: map[string][]string{},
+		}
+	}
+	prevMap, _ := PlanNextMapEx(emptyMap, []string{"a", "b", "c", "d"},
+		nil, nil, model, PlanNextMapOptions{})
+
+	nodesAll := []string{"a", "b", "c", "d", "x", "y"}
+
+	tests := []struct {
+		About          string
+		nodesToRemove  []string
+		nodesToAdd     []string
+		opts           PlanNextMapOptions
+		exp            map[string]string
+		expNumWarnings int
+	}{
+		{
+			About:         "explicit replacements",
+			nodesToRemove: []string{"a", "c"},
+			nodesToAdd:    []string{"x", "y"},
+			opts: PlanNextMapOptions{
+				NodeReplacements: map[string]string{"a": "y", "c": "x"},
+			},
+			exp: map[string]string{"a": "y", "c": "x"},
+		},
+		{
+			About:         "automatic replacements",
+			nodesToRemove: []string{"a", "c"},
+			nodesToAdd:    []string{"x", "y"},
+			opts: PlanNextMapOptions{
+				NodeHierarchy:        nodeHierarchy,
+				AutoNodeReplacements: true,
+			},
+			exp: map[string]string{"a": "x", "c": "y"},
+		},
+		{
+			About:         "invalid replacements are ignored",
+			nodesToRemove: []string{"a", "c"},
+			nodesToAdd:    []string{"x", "y"},
+			opts: PlanNextMapOptions{
+				NodeReplacements: map[string]string{
+					"a": "x", "b": "y", "c": "x",
+				},
+			},
+			expNumWarnings: 2,
+		},
+	}
+	for i, c := range tests {
+		r, rWarnings := PlanNextMapDetailed(prevMap, nodesAll,
+			c.nodesToRemove, c.nodesToAdd, model, c.opts)
+		if len(rWarnings) != c.expNumWarnings {
+			t.Errorf("i: %d, about: %s, expNumWarnings: %d, got: %v",
+				i, c.About, c.expNumWarnings, rWarnings)
+		}
+		for partitionName, partition := range r {
+			for _, node := range flattenNodesByState(partition.NodesByState) {
+				if StringsToMap(c.nodesToRemove)[node] {
+					t.Errorf("i: %d, about: %s, partition: %s,"+
+						" expected removed node: %s to be gone, got: %v",
+						i, c.About, partitionName, node,
+						partition.NodesByState)
+				}
+			}
+		}
+		if c.exp == nil {
+			continue
+		}
+		exp := replaceNodesInMap(prevMap, c.exp)
+		if !reflect.DeepEqual(r, exp) {
+			t.Errorf("i: %d, about: %s, expected only swaps, got: %v",
+				i, c.About, r)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"sort"
+)
+
+// ResilienceOptions represents optional parameters to the
+// AnalyzeResilience() API.  The MinCopies is the copy count that a
+// partition should not drop below after a failure; when <= 0, it
+// defaults to a majority of the copies required by the constraints of
+// the model.  The NodePairs, when true, also analyzes the concurrent
+// failure of every pair of nodes.
+type ResilienceOptions struct {
+	MinCopies int
+	NodePairs bool
+}
+
+// A FailureImpact describes the partitions affected by a failure of
+// some nodes, which are either a single node, a pair of nodes, or all
+// the nodes under a Domain of the NodeHierarchy.  The partition names
+// in each list are sorted, and a partition appears in at most one of
+// the lists.
+type FailureImpact struct {
+	Domain string   `json:"domain,omitempty"`
+	Nodes  []string `json:"nodes"`
+
+	// LostPartitions had every copy on the failed nodes.
+	LostPartitions []string `json:"lostPartitions,omitempty"`
+
+	// LostPrimaries had every copy of the top priority state (e.g.,
+	// "primary") on the failed nodes, but still have other copies.
+	LostPrimaries []string `json:"lostPrimaries,omitempty"`
+
+	// UnderReplicated still have copies, but fewer than MinCopies.
+	UnderReplicated []string `json:"underReplicated,omitempty"`
+}
+
+// AnalyzeResilience reports the impact on the partitionMap of the
+// failure of every single node, of every domain of the nodeHierarchy,
+// and optionally of every pair of nodes.  The nodeHierarchy is
+// optional and is keyed by node, where a value is the node's parent.
+// The single node failures come first, ordered by node, then the
+// domain failures, ordered by domain, then the pairs.  Failures that
+// affect no partitions are left out, so an empty result means the
+// partitionMap tolerates all the analyzed failures.
+func AnalyzeResilience(partitionMap PartitionMap,
+	nodeHierarchy map[string]string, model PartitionModel,
+	opts ResilienceOptions) []*FailureImpact {
+	minCopies := opts.MinCopies
+	if minCopies <= 0 {
+		totalCopies := 0
+		for _, constraints := range calcStateConstraints(model,
+			PlanNextMapOptions{}) {
+			totalCopies += constraints
+		}
+		minCopies = totalCopies/2 + 1
+	}
+
+	topStateName := ""
+	if stateNames := sortStateNames(model); len(stateNames) > 0 {
+		topStateName = stateNames[0]
+	}
+
+	partitionNames := make([]string, 0, len(partitionMap))
+	nodes := []string{}
+	for partitionName, partition := range partitionMap {
+		partitionNames = append(partitionNames, partitionName)
+		nodes = append(nodes, flattenNodesByState(partition.NodesByState)...)
+	}
+	sort.Strings(partitionNames)
+	nodes = StringsIntersectStrings(nodes, nodes) // Remove dupes.
+	sort.Strings(nodes)
+
+	var rv []*FailureImpact
+
+	analyze := func(domain string, failedNodes []string) {
+		failed := StringsToMap(failedNodes)
+
+		impact := &FailureImpact{Domain: domain, Nodes: failedNodes}
+
+		for _, partitionName := range partitionNames {
+			partition := partitionMap[partitionName]
+
+			copies := flattenNodesByState(partition.NodesByState)
+			copies = StringsIntersectStrings(copies, copies)
+			remaining := StringsRemoveStrings(copies, failedNodes)
+			if len(remaining) == len(copies) {
+				continue
+			}
+
+			if len(remaining) <= 0 {
+				impact.LostPartitions =
+					append(impact.LostPartitions, partitionName)
+				continue
+			}
+
+			topNodes := partition.NodesByState[topStateName]
+			numTopFailed := 0
+			for _, node := range topNodes {
+				if failed[node] {
+					numTopFailed++
+				}
+			}
+			if len(topNodes) > 0 && numTopFailed == len(topNodes) {
+				impact.LostPrimaries =
+					append(impact.LostPrimaries, partitionName)
+				continue
+			}
+
+			if len(remaining) < minCopies {
+				impact.UnderReplicated =
+					append(impact.UnderReplicated, partitionName)
+			}
+		}
+
+		if len(impact.LostPartitions) > 0 ||
+			len(impact.LostPrimaries) > 0 ||
+			len(impact.UnderReplicated) > 0 {
+			rv = append(rv, impact)
+		}
+	}
+
+	for _, node := range nodes {
+		analyze("", []string{node})
+	}
+
+	mapChildren := mapParentsToMapChildren(nodeHierarchy)
+
+	domains := make([]string, 0, len(mapChildren))
+	for domain := range mapChildren {
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	sort.Strings(domains)
+
+	for _, domain := range domains {
+		leaves := findLeaves(domain, mapChildren)
+		sort.Strings(leaves)
+		analyze(domain, leaves)
+	}
+
+	if opts.NodePairs {
+		for i, a := range nodes {
+			for _, b := range nodes[i+1:] {
+				analyze("", []string{a, b})
+			}
+		}
+	}
+
+	return rv
+}
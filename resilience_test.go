@@ -0,0 +1,96 @@
+package blance
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAnalyzeResilience(t *testing.T) {
+	nodeHierarchy := map[string]string{
+		"a": "r0", "b": "r0", "c": "r1", "d": "r1",
+	}
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	partitionMap := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{
+			"primary": {"a"}, "replica": {"b"},
+		}},
+		"1": &Partition{Name: "1", NodesByState: map[string][]string{
+			"primary": {"c"}, "replica": {"a"},
+		}},
+		"2": &Partition{Name: "2", NodesByState: map[string][]string{
+			"primary": {"d"}, "replica": {"c"},
+		}},
+	}
+
+	r := AnalyzeResilience(partitionMap, nodeHierarchy, model,
+		ResilienceOptions{})
+	exp := []*FailureImpact{
+		{
+			Nodes:           []string{"a"},
+			LostPrimaries:   []string{"0"},
+			UnderReplicated: []string{"1"},
+		},
+		{
+			Nodes:           []string{"b"},
+			UnderReplicated: []string{"0"},
+		},
+		{
+			Nodes:           []string{"c"},
+			LostPrimaries:   []string{"1"},
+			UnderReplicated: []string{"2"},
+		},
+		{
+			Nodes:         []string{"d"},
+			LostPrimaries: []string{"2"},
+		},
+		{
+			Domain:          "r0",
+			Nodes:           []string{"a", "b"},
+			LostPartitions:  []string{"0"},
+			UnderReplicated: []string{"1"},
+		},
+		{
+			Domain:         "r1",
+			Nodes:          []string{"c", "d"},
+			LostPartitions: []string{"2"},
+			LostPrimaries:  []string{"1"},
+		},
+	}
+	if !reflect.DeepEqual(r, exp) {
+		t.Errorf("exp: %+v, got: %+v", exp, r)
+	}
+
+	// A lower MinCopies tolerates the loss of a replica.
+	r = AnalyzeResilience(partitionMap, nodeHierarchy, model,
+		ResilienceOptions{MinCopies: 1})
+	if len(r) != 5 || !reflect.DeepEqual(r[1].Nodes, []string{"c"}) {
+		t.Errorf("expected node b failure to be tolerated, got: %+v", r)
+	}
+
+	r = AnalyzeResilience(partitionMap, nil, model,
+		ResilienceOptions{NodePairs: true})
+	if len(r) != 10 {
+		t.Errorf("expected 4 nodes and 6 pairs, got: %d", len(r))
+	}
+	expPair := &FailureImpact{
+		Nodes:           []string{"a", "c"},
+		LostPartitions:  []string{"1"},
+		LostPrimaries:   []string{"0"},
+		UnderReplicated: []string{"2"},
+	}
+	if !reflect.DeepEqual(r[5], expPair) {
+		t.Errorf("exp: %+v, got: %+v", expPair, r[5])
+	}
+
+	if AnalyzeResilience(PartitionMap{}, nodeHierarchy, model,
+		ResilienceOptions{}) != nil {
+		t.Errorf("expected no impacts for an empty map")
+	}
+}
@@ -0,0 +1,140 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"sort"
+)
+
+// PlanRoleRebalance computes a next map that balances the top
+// priority state (e.g., "primary") across the nodes, in proportion to
+// the node weights, without moving any data.  Only the states of the
+// nodes that already hold a copy of a partition are permuted, by
+// swapping the state of a node in the top priority state with that
+// of a node in a lower priority state, so CalcPartitionMoves() on the
+// result yields only promote and demote ops.  The options provide the
+// PartitionWeights, NodeWeights and StateNodeWeights, where a node
+// weight of 0 means the node should not hold the top priority state.
+func PlanRoleRebalance(prevMap PartitionMap, model PartitionModel,
+	opts PlanNextMapOptions) PartitionMap {
+	stateNames := sortStateNames(model)
+
+	nextMap := make(PartitionMap, len(prevMap))
+	partitionNames := make([]string, 0, len(prevMap))
+	for partitionName, partition := range prevMap {
+		nextMap[partitionName] = &Partition{
+			Name:         partition.Name,
+			NodesByState: copyNodesByState(partition.NodesByState),
+			KeyRange:     partition.KeyRange,
+		}
+		partitionNames = append(partitionNames, partitionName)
+	}
+	sort.Strings(partitionNames)
+
+	if len(stateNames) < 2 {
+		return nextMap
+	}
+	topStateName := stateNames[0]
+
+	topCounts := countStateNodes(nextMap, opts.PartitionWeights)[topStateName]
+	if topCounts == nil {
+		topCounts = map[string]int{}
+	}
+
+	weight := func(node string) float64 {
+		w, exists := stateNodeWeight(opts.StateNodeWeights,
+			opts.NodeWeights, topStateName, node)
+		if !exists {
+			return 1.0
+		}
+		if w <= 0 {
+			return zeroNodeWeight
+		}
+		return float64(w)
+	}
+
+	// The imbalance is measured as the sum over the nodes of
+	// count^2 / weight, which is least when the counts are in
+	// proportion to the weights, so each swap strictly reduces it.
+	cost := func(node string, count int) float64 {
+		return float64(count) * float64(count) / weight(node)
+	}
+
+	for {
+		bestDelta := 0.0
+		var bestPartition *Partition
+		var bestTop, bestOther, bestOtherState string
+
+		for _, partitionName := range partitionNames {
+			partition := nextMap[partitionName]
+
+			p := 1
+			if w, exists := opts.PartitionWeights[partitionName]; exists {
+				p = w
+			}
+
+			for _, top := range partition.NodesByState[topStateName] {
+				for _, otherState := range stateNames[1:] {
+					for _, other := range partition.NodesByState[otherState] {
+						if nodeHasState(partition, topStateName, other) {
+							continue
+						}
+						delta := cost(top, topCounts[top]-p) -
+							cost(top, topCounts[top]) +
+							cost(other, topCounts[other]+p) -
+							cost(other, topCounts[other])
+						if delta < bestDelta-1e-9 {
+							bestDelta = delta
+							bestPartition = partition
+							bestTop, bestOther, bestOtherState =
+								top, other, otherState
+						}
+					}
+				}
+			}
+		}
+
+		if bestPartition == nil {
+			return nextMap
+		}
+
+		p := 1
+		if w, exists := opts.PartitionWeights[bestPartition.Name]; exists {
+			p = w
+		}
+
+		nodesByState := bestPartition.NodesByState
+		nodesByState[topStateName] = replaceNode(
+			nodesByState[topStateName], bestTop, bestOther)
+		nodesByState[bestOtherState] = replaceNode(
+			nodesByState[bestOtherState], bestOther, bestTop)
+
+		topCounts[bestTop] -= p
+		topCounts[bestOther] += p
+	}
+}
+
+// The weight used in place of a node weight of 0, so that such a node
+// is the least favored but is still part of the balance computations.
+const zeroNodeWeight = 0.000001
+
+// Returns a copy of the nodes, where node a is replaced by node b.
+func replaceNode(nodes []string, a, b string) []string {
+	rv := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if node == a {
+			node = b
+		}
+		rv = append(rv, node)
+	}
+	return rv
+}
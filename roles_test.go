@@ -0,0 +1,112 @@
+package blance
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestPlanRoleRebalance(t *testing.T) {
+	model := PartitionModel{
+		"primary": &PartitionModelState{
+			Priority: 0, Constraints: 1,
+		},
+		"replica": &PartitionModelState{
+			Priority: 1, Constraints: 1,
+		},
+	}
+	replicaNodes := []string{"b", "c", "d"}
+	prevMap := PartitionMap{}
+	for i := 0; i < 12; i++ {
+		partitionName := fmt.Sprintf("%02d", i)
+		prevMap[partitionName] = &Partition{
+			Name: partitionName,
+			NodesByState: map[string][]string{
+				"primary": {"a"},
+				"replica": {replicaNodes[i%len(replicaNodes)]},
+			},
+		}
+	}
+
+	tests := []struct {
+		About      string
+		opts       PlanNextMapOptions
+		expPrimary map[string]int
+	}{
+		{
+			About:      "even weights",
+			expPrimary: map[string]int{"a": 3, "b": 3, "c": 3, "d": 3},
+		},
+		{
+			About: "weighted node",
+			opts: PlanNextMapOptions{
+				NodeWeights: map[string]int{"a": 2, "b": 2},
+			},
+			expPrimary: map[string]int{"a": 4, "b": 4, "c": 2, "d": 2},
+		},
+		{
+			About: "zero weight node",
+			opts: PlanNextMapOptions{
+				NodeWeights: map[string]int{"a": 0},
+			},
+			expPrimary: map[string]int{"b": 4, "c": 4, "d": 4},
+		},
+		{
+			About: "weighted partitions",
+			opts: PlanNextMapOptions{
+				PartitionWeights: map[string]int{"00": 3, "03": 3, "06": 3},
+			},
+			expPrimary: map[string]int{"a": 4, "b": 6, "c": 4, "d": 4},
+		},
+	}
+	for i, c := range tests {
+		r := PlanRoleRebalance(prevMap, model, c.opts)
+
+		primary := countStateNodes(r, c.opts.PartitionWeights)["primary"]
+		for node, count := range primary {
+			if count == 0 {
+				delete(primary, node)
+			}
+		}
+		if !reflect.DeepEqual(primary, c.expPrimary) {
+			t.Errorf("i: %d, about: %s, expPrimary: %v, got: %v",
+				i, c.About, c.expPrimary, primary)
+		}
+
+		for partitionName, partition := range r {
+			prevNodes := flattenNodesByState(
+				prevMap[partitionName].NodesByState)
+			nodes := flattenNodesByState(partition.NodesByState)
+			sort.Strings(prevNodes)
+			sort.Strings(nodes)
+			if !reflect.DeepEqual(prevNodes, nodes) {
+				t.Errorf("i: %d, about: %s, partition: %s,"+
+					" expected same nodes, prevNodes: %v, got: %v",
+					i, c.About, partitionName, prevNodes, nodes)
+			}
+			moves := CalcPartitionMoves([]string{"primary", "replica"},
+				prevMap[partitionName].NodesByState,
+				partition.NodesByState, false)
+			for _, move := range moves {
+				if move.Op != "promote" && move.Op != "demote" {
+					t.Errorf("i: %d, about: %s, unexpected move: %+v",
+						i, c.About, move)
+				}
+			}
+		}
+	}
+
+	if !reflect.DeepEqual(prevMap["00"].NodesByState["primary"],
+		[]string{"a"}) {
+		t.Errorf("expected prevMap to be unchanged")
+	}
+
+	// A balanced map is left as is.
+	r := PlanRoleRebalance(prevMap, model, PlanNextMapOptions{})
+	r2 := PlanRoleRebalance(r, model, PlanNextMapOptions{})
+	if !reflect.DeepEqual(r, r2) {
+		t.Errorf("expected a balanced map to be stable, r: %v, r2: %v",
+			r, r2)
+	}
+}
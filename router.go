@@ -0,0 +1,299 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// A Partitioner maps keys to partitions, according to some
+// partitioning scheme.
+type Partitioner interface {
+	// PartitionForKey returns the name of the partition of the key.
+	PartitionForKey(key string) string
+
+	// PartitionNames returns the names of every partition that the
+	// PartitionForKey() might return.
+	PartitionNames() []string
+}
+
+// NewHashModPartitioner returns a Partitioner where a key belongs to
+// the partition at index (FNV-1a hash of key) % len(partitionNames).
+// The order of the partitionNames is significant.
+func NewHashModPartitioner(partitionNames []string) (Partitioner, error) {
+	if len(partitionNames) <= 0 {
+		return nil, fmt.Errorf("no partitions")
+	}
+	return &hashModPartitioner{
+		partitionNames: append([]string(nil), partitionNames...),
+		hash: func(key string) uint32 {
+			h := fnv.New32a()
+			h.Write([]byte(key))
+			return h.Sum32()
+		},
+	}, nil
+}
+
+// NewCRC32Partitioner returns a Partitioner where a key belongs to
+// the partition at index ((CRC32 of key >> 16) & 0x7fff) %
+// len(partitionNames), which is the vbucket hashing of Couchbase
+// clients when the partitionNames are the vbuckets in order.
+func NewCRC32Partitioner(partitionNames []string) (Partitioner, error) {
+	if len(partitionNames) <= 0 {
+		return nil, fmt.Errorf("no partitions")
+	}
+	return &hashModPartitioner{
+		partitionNames: append([]string(nil), partitionNames...),
+		hash: func(key string) uint32 {
+			return (crc32.ChecksumIEEE([]byte(key)) >> 16) & 0x7fff
+		},
+	}, nil
+}
+
+type hashModPartitioner struct {
+	partitionNames []string
+	hash           func(key string) uint32
+}
+
+func (p *hashModPartitioner) PartitionForKey(key string) string {
+	return p.partitionNames[p.hash(key)%uint32(len(p.partitionNames))]
+}
+
+func (p *hashModPartitioner) PartitionNames() []string {
+	return append([]string(nil), p.partitionNames...)
+}
+
+// NewConsistentHashPartitioner returns a Partitioner that places each
+// partition at pointsPerPartition points on a hash ring, where a key
+// belongs to the partition at the first point at or after the CRC32
+// of the key.  Unlike with hash-mod, adding or removing a partition
+// only moves the keys of the ring segments next to its points.
+func NewConsistentHashPartitioner(partitionNames []string,
+	pointsPerPartition int) (Partitioner, error) {
+	if len(partitionNames) <= 0 {
+		return nil, fmt.Errorf("no partitions")
+	}
+	if pointsPerPartition <= 0 {
+		return nil, fmt.Errorf("pointsPerPartition must be positive: %d",
+			pointsPerPartition)
+	}
+
+	p := &consistentHashPartitioner{
+		partitionNames: append([]string(nil), partitionNames...),
+	}
+	for _, partitionName := range partitionNames {
+		for i := 0; i < pointsPerPartition; i++ {
+			p.points = append(p.points, ringPoint{
+				hash: crc32.ChecksumIEEE(
+					[]byte(partitionName + "-" + strconv.Itoa(i))),
+				partitionName: partitionName,
+			})
+		}
+	}
+	sort.Slice(p.points, func(i, j int) bool {
+		if p.points[i].hash != p.points[j].hash {
+			return p.points[i].hash < p.points[j].hash
+		}
+		return p.points[i].partitionName < p.points[j].partitionName
+	})
+
+	return p, nil
+}
+
+type consistentHashPartitioner struct {
+	partitionNames []string
+	points         []ringPoint // Sorted by hash.
+}
+
+type ringPoint struct {
+	hash          uint32
+	partitionName string
+}
+
+func (p *consistentHashPartitioner) PartitionForKey(key string) string {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(p.points), func(i int) bool {
+		return p.points[i].hash >= h
+	})
+	if i >= len(p.points) {
+		i = 0 // Wrap around the ring.
+	}
+	return p.points[i].partitionName
+}
+
+func (p *consistentHashPartitioner) PartitionNames() []string {
+	return append([]string(nil), p.partitionNames...)
+}
+
+// NewKeyRangePartitioner returns a Partitioner where a key belongs to
+// the partition whose KeyRange contains the key.  The KeyRanges of the
+// partitionMap must pass ValidateKeyRanges().
+func NewKeyRangePartitioner(partitionMap PartitionMap) (Partitioner, error) {
+	if err := ValidateKeyRanges(partitionMap); err != nil {
+		return nil, err
+	}
+	partitions, err := sortPartitionsByKeyRange(partitionMap)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &keyRangePartitioner{}
+	for _, partition := range partitions {
+		p.starts = append(p.starts, partition.KeyRange.Start)
+		p.partitionNames = append(p.partitionNames, partition.Name)
+	}
+	return p, nil
+}
+
+type keyRangePartitioner struct {
+	starts         []string // Sorted, and starts[0] is "".
+	partitionNames []string // Parallel to the starts.
+}
+
+func (p *keyRangePartitioner) PartitionForKey(key string) string {
+	i := sort.Search(len(p.starts), func(i int) bool {
+		return p.starts[i] > key
+	})
+	return p.partitionNames[i-1]
+}
+
+func (p *keyRangePartitioner) PartitionNames() []string {
+	return append([]string(nil), p.partitionNames...)
+}
+
+// ------------------------------------------------------------------
+
+// A Router routes keys to the nodes of their partitions, based on a
+// PartitionMap and a Partitioner.  A Router is safe for concurrent
+// use, and when a new PartitionMap is published, Update() swaps in the
+// new routing atomically, so lookups see either the old or the new
+// routing but never a mix of the two.
+type Router struct {
+	m sync.RWMutex // Protects the fields that follow.
+
+	r *routes
+}
+
+// The routes are immutable once built.
+type routes struct {
+	partitionMap PartitionMap
+	partitioner  Partitioner
+
+	// Keyed by node, then by stateName, and the values are sorted
+	// partition names.
+	nodePartitions map[string]map[string][]string
+}
+
+// NewRouter returns a Router for the partitionMap and partitioner.
+func NewRouter(partitionMap PartitionMap, partitioner Partitioner) (
+	*Router, error) {
+	r, err := buildRoutes(partitionMap, partitioner)
+	if err != nil {
+		return nil, err
+	}
+	return &Router{r: r}, nil
+}
+
+// Update replaces the routing of the Router with the partitionMap and
+// partitioner.  On error, the Router keeps its previous routing.
+func (router *Router) Update(partitionMap PartitionMap,
+	partitioner Partitioner) error {
+	r, err := buildRoutes(partitionMap, partitioner)
+	if err != nil {
+		return err
+	}
+
+	router.m.Lock()
+	router.r = r
+	router.m.Unlock()
+
+	return nil
+}
+
+func (router *Router) routes() *routes {
+	router.m.RLock()
+	r := router.r
+	router.m.RUnlock()
+	return r
+}
+
+// PartitionForKey returns the name of the partition of the key.
+func (router *Router) PartitionForKey(key string) string {
+	return router.routes().partitioner.PartitionForKey(key)
+}
+
+// NodesForKey returns the nodes that hold the partition of the key in
+// the given state, such as the "primary" node to which to route a
+// write.
+func (router *Router) NodesForKey(key, stateName string) []string {
+	r := router.routes()
+	partition := r.partitionMap[r.partitioner.PartitionForKey(key)]
+	return append([]string(nil), partition.NodesByState[stateName]...)
+}
+
+// PartitionsForNode returns the sorted names of the partitions that
+// the node holds in the given state.
+func (router *Router) PartitionsForNode(node, stateName string) []string {
+	r := router.routes()
+	return append([]string(nil), r.nodePartitions[node][stateName]...)
+}
+
+// PartitionsByStateForNode returns the sorted names of the partitions
+// that the node holds, keyed by stateName.
+func (router *Router) PartitionsByStateForNode(
+	node string) map[string][]string {
+	r := router.routes()
+	return copyNodesByState(r.nodePartitions[node])
+}
+
+func buildRoutes(partitionMap PartitionMap, partitioner Partitioner) (
+	*routes, error) {
+	if partitioner == nil {
+		return nil, fmt.Errorf("no partitioner")
+	}
+	for _, partitionName := range partitioner.PartitionNames() {
+		if _, exists := partitionMap[partitionName]; !exists {
+			return nil, fmt.Errorf("partitioner has unknown partition: %q",
+				partitionName)
+		}
+	}
+
+	r := &routes{
+		partitionMap:   copyPartitionMap(partitionMap),
+		partitioner:    partitioner,
+		nodePartitions: map[string]map[string][]string{},
+	}
+	for partitionName, partition := range partitionMap {
+		for stateName, nodes := range partition.NodesByState {
+			for _, node := range nodes {
+				m := r.nodePartitions[node]
+				if m == nil {
+					m = map[string][]string{}
+					r.nodePartitions[node] = m
+				}
+				m[stateName] = append(m[stateName], partitionName)
+			}
+		}
+	}
+	for _, m := range r.nodePartitions {
+		for _, partitionNames := range m {
+			sort.Strings(partitionNames)
+		}
+	}
+
+	return r, nil
+}
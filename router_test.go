@@ -0,0 +1,199 @@
+package blance
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestPartitioners(t *testing.T) {
+	names := func(n int) []string {
+		rv := make([]string, n)
+		for i := range rv {
+			rv[i] = fmt.Sprintf("%d", i)
+		}
+		return rv
+	}
+
+	hashMod, _ := NewHashModPartitioner(names(8))
+	crc, _ := NewCRC32Partitioner(names(1024))
+	ring, _ := NewConsistentHashPartitioner(names(8), 64)
+	ranges, _ := NewKeyRangePartitioner(PartitionMap{
+		"a": &Partition{Name: "a", KeyRange: &KeyRange{"", "key-3"}},
+		"b": &Partition{Name: "b", KeyRange: &KeyRange{"key-3", "key-6"}},
+		"c": &Partition{Name: "c", KeyRange: &KeyRange{"key-6", ""}},
+	})
+
+	tests := []struct {
+		about       string
+		partitioner Partitioner
+		numKeys     int
+		minPerPart  int
+	}{
+		{"hash-mod", hashMod, 8000, 800},
+		{"crc32", crc, 102400, 50},
+		{"ring", ring, 8000, 500},
+		{"ranges", ranges, 9000, 2000},
+	}
+	for i, c := range tests {
+		counts := map[string]int{}
+		for k := 0; k < c.numKeys; k++ {
+			key := fmt.Sprintf("key-%d", k)
+			partitionName := c.partitioner.PartitionForKey(key)
+			if c.partitioner.PartitionForKey(key) != partitionName {
+				t.Errorf("i: %d, about: %s, key: %s, expected stable",
+					i, c.about, key)
+			}
+			counts[partitionName]++
+		}
+		for _, partitionName := range c.partitioner.PartitionNames() {
+			if counts[partitionName] < c.minPerPart {
+				t.Errorf("i: %d, about: %s, partition: %s, count: %d,"+
+					" expected at least: %d", i, c.about, partitionName,
+					counts[partitionName], c.minPerPart)
+			}
+		}
+		if len(counts) != len(c.partitioner.PartitionNames()) {
+			t.Errorf("i: %d, about: %s, unexpected partitions: %v",
+				i, c.about, counts)
+		}
+	}
+
+	for key, exp := range map[string]string{
+		"": "a", "key-2": "a", "key-3": "b", "key-59": "b", "zzz": "c",
+	} {
+		if got := ranges.PartitionForKey(key); got != exp {
+			t.Errorf("key: %q, exp: %s, got: %s", key, exp, got)
+		}
+	}
+
+	// Adding a partition to the ring only moves keys to the new one.
+	ring9, _ := NewConsistentHashPartitioner(names(9), 64)
+	moved := 0
+	for k := 0; k < 8000; k++ {
+		key := fmt.Sprintf("key-%d", k)
+		before, after := ring.PartitionForKey(key), ring9.PartitionForKey(key)
+		if before != after {
+			if after != "8" {
+				t.Errorf("key: %s, moved from: %s to: %s", key, before, after)
+			}
+			moved++
+		}
+	}
+	if moved <= 0 || moved > 2000 {
+		t.Errorf("expected around 1/9 of the keys to move, got: %d", moved)
+	}
+
+	if _, err := NewHashModPartitioner(nil); err == nil {
+		t.Errorf("expected err with no partitions")
+	}
+	if _, err := NewCRC32Partitioner(nil); err == nil {
+		t.Errorf("expected err with no partitions")
+	}
+	if _, err := NewConsistentHashPartitioner(names(2), 0); err == nil {
+		t.Errorf("expected err with no points")
+	}
+	if _, err := NewKeyRangePartitioner(PartitionMap{
+		"a": &Partition{Name: "a", KeyRange: &KeyRange{"", "m"}},
+	}); err == nil {
+		t.Errorf("expected err with invalid key ranges")
+	}
+}
+
+func TestRouter(t *testing.T) {
+	m := PartitionMap{
+		"a": &Partition{Name: "a", NodesByState: map[string][]string{
+			"primary": {"n0"}, "replica": {"n1", "n2"},
+		}, KeyRange: &KeyRange{"", "m"}},
+		"b": &Partition{Name: "b", NodesByState: map[string][]string{
+			"primary": {"n1"}, "replica": {"n0"},
+		}, KeyRange: &KeyRange{"m", ""}},
+	}
+	partitioner, _ := NewKeyRangePartitioner(m)
+
+	router, err := NewRouter(m, partitioner)
+	if err != nil {
+		t.Fatalf("expected no err, got: %v", err)
+	}
+
+	if got := router.PartitionForKey("x"); got != "b" {
+		t.Errorf("expected b, got: %s", got)
+	}
+	if got := router.NodesForKey("c", "replica"); !reflect.DeepEqual(got,
+		[]string{"n1", "n2"}) {
+		t.Errorf("expected n1, n2, got: %v", got)
+	}
+	if got := router.NodesForKey("c", "dead"); len(got) != 0 {
+		t.Errorf("expected no nodes, got: %v", got)
+	}
+	if got := router.PartitionsForNode("n0", "primary"); !reflect.DeepEqual(
+		got, []string{"a"}) {
+		t.Errorf("expected a, got: %v", got)
+	}
+	exp := map[string][]string{"primary": {"b"}, "replica": {"a"}}
+	if got := router.PartitionsByStateForNode("n1"); !reflect.DeepEqual(
+		got, exp) {
+		t.Errorf("exp: %v, got: %v", exp, got)
+	}
+	if got := router.PartitionsByStateForNode("n9"); len(got) != 0 {
+		t.Errorf("expected no partitions, got: %v", got)
+	}
+
+	// Changes to the caller's map or results don't affect the routing.
+	m["a"].NodesByState["primary"][0] = "zz"
+	router.NodesForKey("c", "replica")[0] = "zz"
+	if got := router.NodesForKey("c", "primary"); !reflect.DeepEqual(got,
+		[]string{"n0"}) {
+		t.Errorf("expected n0, got: %v", got)
+	}
+	m["a"].NodesByState["primary"][0] = "n0"
+
+	// A failed update keeps the previous routing.
+	hashMod, _ := NewHashModPartitioner([]string{"a", "b", "c"})
+	if err := router.Update(m, hashMod); err == nil {
+		t.Errorf("expected err with unknown partition")
+	}
+	if err := router.Update(m, nil); err == nil {
+		t.Errorf("expected err with no partitioner")
+	}
+	if got := router.PartitionForKey("x"); got != "b" {
+		t.Errorf("expected b, got: %s", got)
+	}
+
+	// Readers see either the old or the new routing during updates.
+	m2, _ := SplitPartitionByKey(m, "b", []string{"t"}, []string{"b", "c"})
+	m2["c"].NodesByState = map[string][]string{"primary": {"n2"}}
+	partitioner2, _ := NewKeyRangePartitioner(m2)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			got := router.NodesForKey("x", "primary")
+			if !reflect.DeepEqual(got, []string{"n1"}) &&
+				!reflect.DeepEqual(got, []string{"n2"}) {
+				t.Errorf("unexpected nodes: %v", got)
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			router.Update(m2, partitioner2)
+		} else {
+			router.Update(m, partitioner)
+		}
+	}
+	wg.Wait()
+
+	router.Update(m2, partitioner2)
+	if got := router.NodesForKey("x", "primary"); !reflect.DeepEqual(got,
+		[]string{"n2"}) {
+		t.Errorf("expected n2, got: %v", got)
+	}
+	if got := router.PartitionsForNode("n2", "primary"); !reflect.DeepEqual(
+		got, []string{"c"}) {
+		t.Errorf("expected c, got: %v", got)
+	}
+}
@@ -0,0 +1,183 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"fmt"
+)
+
+// SplitPartition returns a copy of the partitionMap where the
+// partition named partitionName is replaced by the partitions of the
+// newPartitionNames, which inherit the NodesByState of the split
+// partition, so the split moves no data.  A new partition may reuse
+// the partitionName, but not the name of another existing partition.
+// The new partitions have no KeyRange; see SplitPartitionByKey().
+func SplitPartition(partitionMap PartitionMap, partitionName string,
+	newPartitionNames []string) (PartitionMap, error) {
+	partition, exists := partitionMap[partitionName]
+	if !exists {
+		return nil, fmt.Errorf("unknown partition: %q", partitionName)
+	}
+	if len(newPartitionNames) <= 0 {
+		return nil, fmt.Errorf("no new partitions for partition: %q",
+			partitionName)
+	}
+
+	rv := copyPartitionMap(partitionMap)
+	delete(rv, partitionName)
+
+	for _, newPartitionName := range newPartitionNames {
+		if _, exists := rv[newPartitionName]; exists {
+			return nil, fmt.Errorf("duplicate partition: %q",
+				newPartitionName)
+		}
+		rv[newPartitionName] = &Partition{
+			Name:         newPartitionName,
+			NodesByState: copyNodesByState(partition.NodesByState),
+		}
+	}
+
+	return rv, nil
+}
+
+// MergePartitions returns a copy of the partitionMap where the
+// partitions of the partitionNames are replaced by a single partition
+// named newPartitionName.  The merged partition takes the NodesByState
+// of one of the merged partitions, chosen to minimize data movement,
+// which is the weight of the merged partitions that would need to be
+// copied to the nodes that don't already hold them.  Ties go to the
+// earlier partition in the partitionNames.  The partitionWeights is
+// optional and is keyed by partitionName; default weight is 1.  The
+// newPartitionName may reuse one of the partitionNames, but not the
+// name of another existing partition.  The merged partition has no
+// KeyRange; see MergePartitionsByKey().
+func MergePartitions(partitionMap PartitionMap, partitionNames []string,
+	newPartitionName string, partitionWeights map[string]int) (
+	PartitionMap, error) {
+	if len(partitionNames) <= 0 {
+		return nil, fmt.Errorf("no partitions to merge into: %q",
+			newPartitionName)
+	}
+
+	for _, partitionName := range partitionNames {
+		if _, exists := partitionMap[partitionName]; !exists {
+			return nil, fmt.Errorf("unknown partition: %q", partitionName)
+		}
+	}
+
+	var best *Partition
+	bestCost := 0
+	for _, partitionName := range partitionNames {
+		partition := partitionMap[partitionName]
+
+		nodes := flattenNodesByState(partition.NodesByState)
+
+		cost := 0
+		for _, otherName := range partitionNames {
+			otherNodes := flattenNodesByState(
+				partitionMap[otherName].NodesByState)
+			cost += partitionWeight(partitionWeights, otherName) *
+				len(StringsRemoveStrings(
+					StringsIntersectStrings(nodes, nodes), otherNodes))
+		}
+
+		if best == nil || cost < bestCost {
+			best, bestCost = partition, cost
+		}
+	}
+
+	rv := copyPartitionMap(partitionMap)
+	for _, partitionName := range partitionNames {
+		delete(rv, partitionName)
+	}
+
+	if _, exists := rv[newPartitionName]; exists {
+		return nil, fmt.Errorf("duplicate partition: %q", newPartitionName)
+	}
+	rv[newPartitionName] = &Partition{
+		Name:         newPartitionName,
+		NodesByState: copyNodesByState(best.NodesByState),
+	}
+
+	return rv, nil
+}
+
+// SplitPartitionWeights returns a copy of the partitionWeights where
+// the weight of the partitionName (default 1) is divided evenly
+// amongst the newPartitionNames, with any remainder going to the
+// earlier new partitions, for use with SplitPartition().
+func SplitPartitionWeights(partitionWeights map[string]int,
+	partitionName string, newPartitionNames []string) map[string]int {
+	rv := copyPartitionWeights(partitionWeights)
+	if len(newPartitionNames) <= 0 {
+		return rv
+	}
+
+	w := partitionWeight(partitionWeights, partitionName)
+	delete(rv, partitionName)
+
+	n := len(newPartitionNames)
+	for i, newPartitionName := range newPartitionNames {
+		rv[newPartitionName] = w / n
+		if i < w%n {
+			rv[newPartitionName]++
+		}
+	}
+
+	return rv
+}
+
+// MergePartitionWeights returns a copy of the partitionWeights where
+// the weights of the partitionNames (default 1 each) are summed into
+// the weight of the newPartitionName, for use with MergePartitions().
+func MergePartitionWeights(partitionWeights map[string]int,
+	partitionNames []string, newPartitionName string) map[string]int {
+	rv := copyPartitionWeights(partitionWeights)
+
+	sum := 0
+	for _, partitionName := range partitionNames {
+		sum += partitionWeight(partitionWeights, partitionName)
+		delete(rv, partitionName)
+	}
+	rv[newPartitionName] = sum
+
+	return rv
+}
+
+// Returns the weight of a partition, where the default weight is 1.
+func partitionWeight(partitionWeights map[string]int,
+	partitionName string) int {
+	if w, exists := partitionWeights[partitionName]; exists {
+		return w
+	}
+	return 1
+}
+
+func copyPartitionWeights(partitionWeights map[string]int) map[string]int {
+	rv := make(map[string]int, len(partitionWeights))
+	for partitionName, w := range partitionWeights {
+		rv[partitionName] = w
+	}
+	return rv
+}
+
+func copyPartitionMap(partitionMap PartitionMap) PartitionMap {
+	rv := make(PartitionMap, len(partitionMap))
+	for partitionName, partition := range partitionMap {
+		rv[partitionName] = &Partition{
+			Name:         partition.Name,
+			NodesByState: copyNodesByState(partition.NodesByState),
+			KeyRange:     partition.KeyRange,
+		}
+	}
+	return rv
+}
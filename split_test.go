@@ -0,0 +1,143 @@
+package blance
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitPartition(t *testing.T) {
+	m := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{
+			"primary": {"a"}, "replica": {"b"},
+		}},
+		"1": &Partition{Name: "1", NodesByState: map[string][]string{
+			"primary": {"b"}, "replica": {"c"},
+		}},
+	}
+	tests := []struct {
+		partitionName     string
+		newPartitionNames []string
+		exp               PartitionMap
+		expErr            bool
+	}{
+		{"0", []string{"0a", "0b"}, PartitionMap{
+			"0a": &Partition{Name: "0a", NodesByState: map[string][]string{
+				"primary": {"a"}, "replica": {"b"},
+			}},
+			"0b": &Partition{Name: "0b", NodesByState: map[string][]string{
+				"primary": {"a"}, "replica": {"b"},
+			}},
+			"1": &Partition{Name: "1", NodesByState: map[string][]string{
+				"primary": {"b"}, "replica": {"c"},
+			}},
+		}, false},
+		{"1", []string{"1", "2"}, PartitionMap{
+			"0": &Partition{Name: "0", NodesByState: map[string][]string{
+				"primary": {"a"}, "replica": {"b"},
+			}},
+			"1": &Partition{Name: "1", NodesByState: map[string][]string{
+				"primary": {"b"}, "replica": {"c"},
+			}},
+			"2": &Partition{Name: "2", NodesByState: map[string][]string{
+				"primary": {"b"}, "replica": {"c"},
+			}},
+		}, false},
+		{"x", []string{"0a"}, nil, true},
+		{"0", nil, nil, true},
+		{"0", []string{"1"}, nil, true},
+		{"0", []string{"0a", "0a"}, nil, true},
+	}
+	for i, c := range tests {
+		r, err := SplitPartition(m, c.partitionName, c.newPartitionNames)
+		if (err != nil) != c.expErr {
+			t.Errorf("i: %d, expErr: %v, got: %v", i, c.expErr, err)
+		}
+		if !reflect.DeepEqual(r, c.exp) {
+			t.Errorf("i: %d, exp: %v, got: %v", i, c.exp, r)
+		}
+	}
+
+	// The children don't share the parent's slices.
+	r, _ := SplitPartition(m, "0", []string{"0a", "0b"})
+	r["0a"].NodesByState["primary"][0] = "z"
+	if r["0b"].NodesByState["primary"][0] != "a" ||
+		m["0"].NodesByState["primary"][0] != "a" {
+		t.Errorf("expected copies of the NodesByState")
+	}
+}
+
+func TestMergePartitions(t *testing.T) {
+	m := PartitionMap{
+		"0": &Partition{Name: "0", NodesByState: map[string][]string{
+			"primary": {"a"}, "replica": {"b"},
+		}},
+		"1": &Partition{Name: "1", NodesByState: map[string][]string{
+			"primary": {"b"}, "replica": {"c"},
+		}},
+		"2": &Partition{Name: "2", NodesByState: map[string][]string{
+			"primary": {"c"}, "replica": {"b"},
+		}},
+	}
+	tests := []struct {
+		partitionNames   []string
+		newPartitionName string
+		partitionWeights map[string]int
+		exp              map[string][]string
+		expErr           bool
+	}{
+		// Ties go to the earlier partition.
+		{[]string{"0", "1"}, "01", nil,
+			map[string][]string{"primary": {"a"}, "replica": {"b"}}, false},
+		// Partitions 1 and 2 share their nodes, so either is free.
+		{[]string{"0", "1", "2"}, "0", nil,
+			map[string][]string{"primary": {"b"}, "replica": {"c"}}, false},
+		{[]string{"0", "1"}, "01", map[string]int{"1": 3},
+			map[string][]string{"primary": {"b"}, "replica": {"c"}}, false},
+		{[]string{"0", "x"}, "0x", nil, nil, true},
+		{nil, "0", nil, nil, true},
+		{[]string{"0", "1"}, "2", nil, nil, true},
+	}
+	for i, c := range tests {
+		r, err := MergePartitions(m, c.partitionNames, c.newPartitionName,
+			c.partitionWeights)
+		if (err != nil) != c.expErr {
+			t.Errorf("i: %d, expErr: %v, got: %v", i, c.expErr, err)
+		}
+		if c.expErr {
+			continue
+		}
+		if len(r) != len(m)-len(c.partitionNames)+1 {
+			t.Errorf("i: %d, unexpected partitions, got: %v", i, r)
+		}
+		if !reflect.DeepEqual(r[c.newPartitionName].NodesByState, c.exp) {
+			t.Errorf("i: %d, exp: %v, got: %v",
+				i, c.exp, r[c.newPartitionName].NodesByState)
+		}
+	}
+}
+
+func TestPartitionWeightsSplitMerge(t *testing.T) {
+	weights := map[string]int{"0": 5, "2": 7}
+
+	r := SplitPartitionWeights(weights, "0", []string{"0a", "0b"})
+	exp := map[string]int{"0a": 3, "0b": 2, "2": 7}
+	if !reflect.DeepEqual(r, exp) {
+		t.Errorf("exp: %v, got: %v", exp, r)
+	}
+
+	r = SplitPartitionWeights(nil, "1", []string{"1a", "1b"})
+	exp = map[string]int{"1a": 1, "1b": 0}
+	if !reflect.DeepEqual(r, exp) {
+		t.Errorf("exp: %v, got: %v", exp, r)
+	}
+
+	r = MergePartitionWeights(weights, []string{"0", "1", "2"}, "012")
+	exp = map[string]int{"012": 13}
+	if !reflect.DeepEqual(r, exp) {
+		t.Errorf("exp: %v, got: %v", exp, r)
+	}
+
+	if !reflect.DeepEqual(weights, map[string]int{"0": 5, "2": 7}) {
+		t.Errorf("expected weights to be unchanged, got: %v", weights)
+	}
+}
@@ -0,0 +1,231 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package blance
+
+import (
+	"math"
+	"reflect"
+	"sort"
+)
+
+// Returns a map that starts from the begMap and takes only as many of
+// the partition assignments of the endMap as are needed to bring the
+// weighted load of every node in every state within the
+// opts.BalanceTolerance of its fair share for the state, along with
+// the names of the partitions that kept their begMap assignments
+// instead of their different endMap assignments.  The assignments of
+// a partition that has copies on the nodesToRemove, that doesn't meet
+// the constraints, or that the planner reassigned to meet a placement
+// rule (the fixedPartitions) are always taken.
+// The remaining assignments are then taken one partition at a time,
+// favoring the partition that most reduces the imbalance, until every
+// node is within the tolerance or no partition reduces the imbalance.
+func applyBalanceTolerance(begMap, endMap PartitionMap,
+	nodes, nodesToRemove []string, fixedPartitions map[string]bool,
+	model PartitionModel, opts PlanNextMapOptions) (
+	PartitionMap, map[string]bool) {
+	stateConstraints := calcStateConstraints(model, opts)
+
+	stateNames := sortStateNames(model)
+
+	removes := StringsToMap(nodesToRemove)
+
+	rv := make(PartitionMap, len(begMap))
+
+	var optional []string
+	for partitionName, begPartition := range begMap {
+		partition := &Partition{
+			Name:         begPartition.Name,
+			NodesByState: copyNodesByState(begPartition.NodesByState),
+			KeyRange:     begPartition.KeyRange,
+		}
+
+		endPartition, exists := endMap[partitionName]
+		if !exists {
+			rv[partitionName] = partition
+			continue
+		}
+
+		mandatory := fixedPartitions[partitionName]
+		for _, node := range flattenNodesByState(partition.NodesByState) {
+			if removes[node] {
+				mandatory = true
+			}
+		}
+		for stateName, constraints := range stateConstraints {
+			if len(partition.NodesByState[stateName]) != constraints {
+				mandatory = true
+			}
+		}
+
+		if mandatory {
+			rv[partitionName] = endPartition
+		} else {
+			rv[partitionName] = partition
+			if !reflect.DeepEqual(partition, endPartition) {
+				optional = append(optional, partitionName)
+			}
+		}
+	}
+	sort.Strings(optional)
+
+	stateNodeCounts := countStateNodes(rv, opts.PartitionWeights)
+
+	// The loads and fair shares are kept per state, so that a skew in
+	// one state, such as every primary on one node, isn't hidden by an
+	// opposite skew in another state.  The fair share of a node for a
+	// state is the load of the state divided amongst the nodes by their
+	// weights for the state, where the weights are the same as used by
+	// the planner.  The nodesToRemove and nodes with a weight of 0 have
+	// no fair share, so any load on them is out of tolerance.
+	loads := map[string]map[string]float64{}      // Keyed by stateName, node.
+	fairShares := map[string]map[string]float64{} // Keyed by stateName, node.
+	weights := map[string]map[string]float64{}    // Keyed by stateName, node.
+	for _, stateName := range stateNames {
+		loads[stateName] = countNodeLoads(map[string]map[string]int{
+			stateName: stateNodeCounts[stateName],
+		}, opts.StateLoadFactor)
+		fairShares[stateName] = map[string]float64{}
+		weights[stateName] = map[string]float64{}
+
+		totalWeight := 0.0
+		for _, node := range nodes {
+			w := 1.0
+			if sw, exists := stateNodeWeight(opts.StateNodeWeights,
+				opts.NodeWeights, stateName, node); exists {
+				w = float64(sw)
+			}
+			if w > 0 && !removes[node] {
+				weights[stateName][node] = w
+				totalWeight += w
+			}
+		}
+		if totalWeight <= 0 {
+			continue
+		}
+
+		totalLoad := 0.0
+		for _, load := range loads[stateName] {
+			totalLoad += load
+		}
+
+		for node, w := range weights[stateName] {
+			fairShares[stateName][node] = totalLoad * w / totalWeight
+		}
+	}
+
+	withinTolerance := func() bool {
+		for _, stateName := range stateNames {
+			for _, node := range nodes {
+				load := loads[stateName][node]
+				fair := fairShares[stateName][node]
+				if math.Abs(load-fair) > opts.BalanceTolerance*fair+1e-9 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	// Returns the change in the load of each state and node if the
+	// partition's assignments were changed from the beg to the end.
+	loadDeltas := func(partitionName string,
+		beg, end *Partition) map[string]map[string]float64 {
+		partitionWeight := 1.0
+		if w, exists := opts.PartitionWeights[partitionName]; exists {
+			partitionWeight = float64(w)
+		}
+		rv := map[string]map[string]float64{}
+		add := func(nodesByState map[string][]string, sign float64) {
+			for stateName, nodes := range nodesByState {
+				if loads[stateName] == nil {
+					continue // Not a state of the model.
+				}
+				loadFactor := 1.0
+				if f, exists := opts.StateLoadFactor[stateName]; exists {
+					loadFactor = f
+				}
+				if rv[stateName] == nil {
+					rv[stateName] = map[string]float64{}
+				}
+				for _, node := range nodes {
+					rv[stateName][node] += sign * loadFactor * partitionWeight
+				}
+			}
+		}
+		add(beg.NodesByState, -1)
+		add(end.NodesByState, 1)
+		return rv
+	}
+
+	isNode := StringsToMap(nodes)
+
+	// The imbalance is the sum over the states and nodes of the squared
+	// difference between a node's load and its fair share, scaled by
+	// the node's weight for the state, where a node without a fair
+	// share has a weight of 1.
+	imbalanceDelta := func(deltas map[string]map[string]float64) float64 {
+		rv := 0.0
+		for stateName, nodeDeltas := range deltas {
+			for node, delta := range nodeDeltas {
+				if !isNode[node] {
+					continue
+				}
+				w := weights[stateName][node]
+				if w <= 0 {
+					w = 1
+				}
+				before := loads[stateName][node] - fairShares[stateName][node]
+				after := before + delta
+				rv += (after*after - before*before) / w
+			}
+		}
+		return rv
+	}
+
+	for !withinTolerance() {
+		bestIdx, bestDelta := -1, 0.0
+		var bestDeltas map[string]map[string]float64
+		for i, partitionName := range optional {
+			if partitionName == "" {
+				continue // Already taken.
+			}
+			deltas := loadDeltas(partitionName,
+				rv[partitionName], endMap[partitionName])
+			delta := imbalanceDelta(deltas)
+			if delta < bestDelta-1e-9 {
+				bestIdx, bestDelta, bestDeltas = i, delta, deltas
+			}
+		}
+		if bestIdx < 0 {
+			break
+		}
+
+		partitionName := optional[bestIdx]
+		rv[partitionName] = endMap[partitionName]
+		for stateName, nodeDeltas := range bestDeltas {
+			for node, delta := range nodeDeltas {
+				loads[stateName][node] += delta
+			}
+		}
+		optional[bestIdx] = ""
+	}
+
+	keptPartitions := map[string]bool{}
+	for _, partitionName := range optional {
+		if partitionName != "" {
+			keptPartitions[partitionName] = true
+		}
+	}
+
+	return rv, keptPartitions
+}